@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// contentPath is where uploadImageHandler stored the file for a content.
+func contentPath(name string) string {
+	return filepath.Join("uploads", filepath.Base(name))
+}
+
+// removeContentFile removes the file of a content whose row is gone, unless
+// another content is still stored under the same name.
+func (app *application) removeContentFile(name string) error {
+	owners, err := app.extended.Contents.FileOwners(name)
+	if err != nil || len(owners) > 0 {
+		return err
+	}
+
+	err = os.Remove(contentPath(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// exportUserDataHandler streams a ZIP archive of everything held about the
+// user: profile, permissions, sessions, the metadata of their contents and
+// the uploaded files themselves. Contents are owned by the hashed user ID
+// that hashImage assigns.
+func (app *application) exportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := app.loadProfile(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := app.extended.Sessions.GetAllForUser(profile.ID, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	contents, err := app.extended.Contents.GetAllForUser(HashID(profile.ID))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	deletion, err := app.extended.Deletions.Get(profile.ID)
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	documents := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", envelope{"user": profile, "deletion": deletion}},
+		{"permissions.json", envelope{"permissions": profile.Permissions}},
+		{"sessions.json", envelope{"sessions": sessions}},
+		{"contents.json", envelope{"contents": contents}},
+	}
+
+	filename := fmt.Sprintf("export-%d-%s.zip", profile.ID, time.Now().UTC().Format("20060102"))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// The status line has gone out, so from here on failures can only be
+	// logged. A truncated archive fails to open rather than looking complete.
+	zw := zip.NewWriter(w)
+
+	for _, doc := range documents {
+		err := writeZipJSON(zw, doc.name, doc.data)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	written := make(map[string]bool)
+
+	for _, content := range contents {
+		name := filepath.Base(content.Name)
+		if written[name] {
+			continue
+		}
+		written[name] = true
+
+		// The file may have been overwritten by another user's upload of
+		// the same name, so leave it out rather than risk exporting theirs.
+		owners, err := app.extended.Contents.FileOwners(content.Name)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		if slices.ContainsFunc(owners, func(owner string) bool { return owner != content.UserID }) {
+			continue
+		}
+
+		err = writeZipFile(zw, "files/"+name, contentPath(content.Name), content.CreatedAt)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			app.logError(r, err)
+			return
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func writeZipJSON(zw *zip.Writer, name string, data any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(js, '\n'))
+	return err
+}
+
+func writeZipFile(zw *zip.Writer, name, path string, modified time.Time) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, src)
+	return err
+}
+
+// deleteAccountHandler schedules the account for deletion once the grace
+// period has passed and signs out every session. Signing back in and calling
+// cancelAccountDeletionHandler before then keeps the account.
+func (app *application) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(app.contextGetUser(r).Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	deletion, err := app.extended.Deletions.Schedule(user.ID, time.Now().Add(app.config.accounts.deletionGrace))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeAllCredentials(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := map[string]any{
+		"purgeAt": deletion.PurgeAt.UTC().Format(time.RFC1123),
+	}
+
+	err = app.enqueueEmail(user.Email, "account_deletion_scheduled.tmpl", data)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("account deletion scheduled", "user_id", user.ID, "purge_at", deletion.PurgeAt)
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"deletion": deletion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeAllCredentials logs the user out everywhere and also revokes the API
+// keys and OAuth grants that would otherwise keep acting for them.
+func (app *application) revokeAllCredentials(userID int64) error {
+	err := app.revokeAllSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	err = app.extended.APIKeys.DeleteAllForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{extended.ScopeOAuthCode, extended.ScopeOAuthAccess, extended.ScopeOAuthRefresh} {
+		err = app.models.Tokens.DeleteAllForUser(scope, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *application) cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.extended.Deletions.Cancel(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.Info("account deletion cancelled", "user_id", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account deletion cancelled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// startAccountPurger deletes accounts whose grace period has run out every
+// purgeInterval until ctx is cancelled.
+func (app *application) startAccountPurger(ctx context.Context) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.accounts.purgeInterval)
+		defer ticker.Stop()
+
+		for {
+			app.purgeAccounts(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (app *application) purgeAccounts(ctx context.Context) {
+	for ctx.Err() == nil {
+		userIDs, err := app.extended.Deletions.GetDue(100)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		if len(userIDs) == 0 {
+			return
+		}
+
+		for _, userID := range userIDs {
+			if !app.purgeAccount(userID) {
+				return
+			}
+		}
+	}
+}
+
+// purgeAccount removes the user's rows and then their uploaded files. A file
+// that cannot be removed is logged and left behind rather than keeping the
+// account. It returns false if the purge run should stop.
+func (app *application) purgeAccount(userID int64) bool {
+	names, err := app.extended.Deletions.Purge(userID, HashID(userID))
+	if err != nil {
+		if errors.Is(err, extended.ErrRecordNotFound) {
+			return true
+		}
+		app.logger.Error(err.Error(), "user_id", userID)
+		return false
+	}
+	app.invalidateUser(userID)
+
+	for _, name := range names {
+		err := app.removeContentFile(name)
+		if err != nil {
+			app.logger.Error(err.Error(), "user_id", userID, "file", name)
+		}
+	}
+
+	app.logger.Info("account purged", "user_id", userID, "contents", len(names))
+	return true
+}
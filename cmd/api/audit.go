@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/pistolricks/go-api-template/internal/extended"
+)
+
+// audit records event in the audit log. Auditing never fails the caller: if
+// the event cannot be stored it is written to the application log instead.
+func (app *application) audit(event *extended.AuditEvent) {
+	err := app.extended.Audit.Insert(event)
+	if err != nil {
+		app.logger.Error(err.Error(),
+			"action", event.Action,
+			"outcome", event.Outcome,
+			"reason", event.Reason,
+			"user_id", event.UserID,
+			"email", event.Email,
+			"ip", event.IP,
+		)
+	}
+}
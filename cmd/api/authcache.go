@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"expvar"
+	"github.com/pistolricks/models/cmd/models"
+	"golang.org/x/sync/singleflight"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var authCacheStats = expvar.NewMap("auth_cache")
+
+// authCache maps the hash of an opaque access token to the user it belongs
+// to, so that authenticate does not query the database on every request.
+//
+// A cached entry can outlive its token by up to ttl, so anything that
+// revokes a token or changes a user must call invalidateUser. Concurrent
+// misses for the same token share one load.
+type authCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[[32]byte]authCacheEntry
+	byUser  map[int64]map[[32]byte]struct{}
+	// generation is bumped by every invalidation. A load that started before
+	// one may have read the old state, so its result is not cached.
+	generation uint64
+
+	group singleflight.Group
+}
+
+type authCacheEntry struct {
+	user    models.User
+	expires time.Time
+}
+
+func newAuthCache(ttl time.Duration, size int) *authCache {
+	return &authCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[[32]byte]authCacheEntry),
+		byUser:  make(map[int64]map[[32]byte]struct{}),
+	}
+}
+
+// get returns the user for token, calling load on a miss. Each caller gets
+// its own copy of the user.
+func (c *authCache) get(token string, load func() (*models.User, error)) (*models.User, error) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return load()
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	entry, found := c.entries[hash]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if found && time.Now().Before(entry.expires) {
+		authCacheStats.Add("hits", 1)
+		user := entry.user
+		return &user, nil
+	}
+
+	authCacheStats.Add("misses", 1)
+
+	// Loads are only shared within a generation, so a request arriving after
+	// an invalidation never receives what a load started before it read.
+	key := string(hash[:]) + ":" + strconv.FormatUint(generation, 10)
+
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		user, err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		c.put(hash, *user, generation)
+		return *user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user := v.(models.User)
+	return &user, nil
+}
+
+func (c *authCache) put(hash [32]byte, user models.User, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	now := time.Now()
+
+	if len(c.entries) >= c.size {
+		for h, entry := range c.entries {
+			if now.After(entry.expires) {
+				c.remove(h)
+			}
+		}
+	}
+
+	// Still full of live entries: drop arbitrary ones, relying on map
+	// iteration order being random.
+	for h := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		c.remove(h)
+		authCacheStats.Add("evictions", 1)
+	}
+
+	c.entries[hash] = authCacheEntry{user: user, expires: now.Add(c.ttl)}
+
+	if c.byUser[user.ID] == nil {
+		c.byUser[user.ID] = make(map[[32]byte]struct{})
+	}
+	c.byUser[user.ID][hash] = struct{}{}
+}
+
+// remove must be called with c.mu held.
+func (c *authCache) remove(hash [32]byte) {
+	entry, found := c.entries[hash]
+	if !found {
+		return
+	}
+
+	delete(c.entries, hash)
+
+	hashes := c.byUser[entry.user.ID]
+	delete(hashes, hash)
+	if len(hashes) == 0 {
+		delete(c.byUser, entry.user.ID)
+	}
+}
+
+func (c *authCache) invalidateUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for hash := range c.byUser[userID] {
+		c.remove(hash)
+	}
+}
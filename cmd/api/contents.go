@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/julienschmidt/httprouter"
 	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/policy"
 	"github.com/pistolricks/validation"
 	"mime/multipart"
 	"net/http"
@@ -121,3 +124,45 @@ func (app *application) createFile(w http.ResponseWriter, r *http.Request, filen
 
 	return dst, nil
 }
+
+// deleteContentHandler removes a content and its file. Who may do so is up to
+// the policy, which sees the content's owner.
+func (app *application) deleteContentHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	content, err := app.extended.Contents.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.authorize(w, r, "contents:delete", policy.Attributes{"id": content.ID, "owner": content.UserID}) {
+		return
+	}
+
+	err = app.extended.Contents.Delete(content.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.removeContentFile(content.Name)
+	if err != nil {
+		app.logger.Error(err.Error(), "content_id", content.ID, "file", content.Name)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "content successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -4,14 +4,31 @@ import (
 	"context"
 	"github.com/pistolricks/models/cmd/models"
 	"net/http"
+	"sync"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	permissionsContextKey = contextKey("permissions")
+	tokenContextKey       = contextKey("token")
+	scopesContextKey      = contextKey("scopes")
+)
+
+// requestPermissions holds the effective permissions of the request's user,
+// loaded the first time something asks for them.
+type requestPermissions struct {
+	once        sync.Once
+	permissions models.Permissions
+	err         error
+}
 
+// contextSetUser also resets the user's permissions, so that they always
+// belong to the user currently in the context.
 func (app *application) contextSetUser(r *http.Request, user *models.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, permissionsContextKey, &requestPermissions{})
 	return r.WithContext(ctx)
 }
 
@@ -22,3 +39,53 @@ func (app *application) contextGetUser(r *http.Request) *models.User {
 	}
 	return user
 }
+
+// contextGetPermissions returns the effective permissions of the request's
+// user. They are loaded at most once per request, through app.permissionCache,
+// however many guards and handlers ask for them.
+func (app *application) contextGetPermissions(r *http.Request) (models.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	rp, ok := r.Context().Value(permissionsContextKey).(*requestPermissions)
+	if !ok {
+		panic("missing permissions value in request context")
+	}
+
+	rp.once.Do(func() {
+		if user.IsAnonymous() {
+			rp.permissions = models.Permissions{}
+			return
+		}
+
+		rp.permissions, rp.err = app.permissionCache.get(user.ID, func() (models.Permissions, error) {
+			return app.extended.Permissions.GetAllForUser(user.ID)
+		})
+	})
+
+	return rp.permissions, rp.err
+}
+
+func (app *application) contextSetToken(r *http.Request, tokenPlaintext string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, tokenPlaintext)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the plaintext authentication token presented with
+// the request, or an empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+func (app *application) contextSetScopes(r *http.Request, scopes models.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), scopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// contextGetScopes returns the permission codes a delegated credential (an
+// API key or OAuth access token) is limited to. A nil result means the
+// request carries the user's own credentials and is not restricted.
+func (app *application) contextGetScopes(r *http.Request) models.Permissions {
+	scopes, _ := r.Context().Value(scopesContextKey).(models.Permissions)
+	return scopes
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	emailChangeTTL = 24 * time.Hour
+	emailRevertTTL = 7 * 24 * time.Hour
+)
+
+// requestEmailChangeHandler sends a confirmation token to the new address and
+// a heads-up to the current one. The address only changes once the token is
+// presented to confirmEmailChangeHandler.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	models.ValidateEmail(v, input.Email)
+	models.ValidatePasswordPlaintext(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(app.contextGetUser(r).Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from your current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, models.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the most recent request can be confirmed.
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.extended.Tokens.NewForEmail(user.ID, emailChangeTTL, extended.ScopeEmailChange, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenIssued(user.ID, extended.ScopeEmailChange, "")
+
+	data := map[string]any{
+		"emailChangeToken": token.Plaintext,
+		"newEmail":         input.Email,
+	}
+
+	err = app.enqueueEmail(input.Email, "email_change_confirm.tmpl", data)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.enqueueEmail(user.Email, "email_change_notice.tmpl", map[string]any{"newEmail": input.Email})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "a confirmation link has been sent to the new email address"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler applies a requested change and gives the previous
+// address a token to undo it for emailRevertTTL.
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user, newEmail, ok := app.userForEmailToken(w, r, extended.ScopeEmailChange)
+	if !ok {
+		return
+	}
+
+	oldEmail := user.Email
+
+	if !app.setUserEmail(w, r, user, newEmail) {
+		return
+	}
+
+	// Anything mailed to the old address for this account must stop working.
+	for _, scope := range []string{extended.ScopeEmailChange, models.ScopePasswordReset} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	token, err := app.extended.Tokens.NewForEmail(user.ID, emailRevertTTL, extended.ScopeEmailRevert, oldEmail)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenIssued(user.ID, extended.ScopeEmailRevert, "")
+
+	data := map[string]any{
+		"emailRevertToken": token.Plaintext,
+		"newEmail":         newEmail,
+		"revertWindow":     "7 days",
+	}
+
+	err = app.enqueueEmail(oldEmail, "email_change_revert.tmpl", data)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revertEmailChangeHandler restores the previous address. A revert suggests
+// the account was taken over, so every session is signed out as well.
+func (app *application) revertEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user, oldEmail, ok := app.userForEmailToken(w, r, extended.ScopeEmailRevert)
+	if !ok {
+		return
+	}
+
+	if !app.setUserEmail(w, r, user, oldEmail) {
+		return
+	}
+
+	for _, scope := range []string{extended.ScopeEmailRevert, extended.ScopeEmailChange, models.ScopePasswordReset} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Warn("email change reverted", "user_id", user.ID)
+
+	env := envelope{"message": "your email address has been restored and all sessions signed out; please reset your password"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// userForEmailToken reads a {"token": ...} body and returns the token's owner,
+// with its password hash so it can be updated, and the email address the
+// token carries. It writes the response itself whenever it returns false.
+func (app *application) userForEmailToken(w http.ResponseWriter, r *http.Request, scope string) (*models.User, string, bool) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, "", false
+	}
+
+	v := validation.New()
+
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, "", false
+	}
+
+	userID, email, err := app.extended.Tokens.GetEmailForPlaintext(scope, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, "", false
+	}
+
+	user, err := app.extended.Users.Get(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, "", false
+	}
+
+	user, err = app.models.Users.GetByEmail(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, "", false
+	}
+
+	return user, email, true
+}
+
+func (app *application) setUserEmail(w http.ResponseWriter, r *http.Request, user *models.User, email string) bool {
+	user.Email = email
+
+	err := app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrDuplicateEmail):
+			v := validation.New()
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, models.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	app.invalidateUser(user.ID)
+	return true
+}
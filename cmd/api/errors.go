@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -56,6 +59,12 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -67,6 +76,12 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	message := "invalid, expired or revoked api key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "authentication is required to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -81,3 +96,32 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "Your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) unlinkedIdentityResponse(w http.ResponseWriter, r *http.Request) {
+	message := "no account matches a verified email address for this identity"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) mfaAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled for this account"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// oauthErrorResponse writes an RFC 6749 section 5.2 error body, which OAuth
+// clients expect in place of the usual error envelope.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	env := envelope{"error": code}
+	if description != "" {
+		env["error_description"] = description
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
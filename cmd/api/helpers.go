@@ -133,20 +133,6 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
-	go func() {
-		defer app.wg.Done()
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.Error(fmt.Sprintf("%v", err))
-			}
-		}()
-
-		fn()
-	}()
-}
-
 func HashID(id int64) string {
 	idString := strconv.FormatInt(id, 10)
 	hasher := sha256.New()
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"time"
+)
+
+const (
+	jobSendEmail          = "send_email"
+	jobActivationToken    = "activation_token"
+	jobPasswordResetToken = "password_reset_token"
+)
+
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// typedJob adapts a handler taking a concrete payload type into a jobHandler.
+// Numbers are decoded as json.Number so IDs survive the round trip through
+// the jobs table unchanged.
+func typedJob[T any](fn func(ctx context.Context, payload T) error) jobHandler {
+	return func(ctx context.Context, raw json.RawMessage) error {
+		var payload T
+
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+
+		err := dec.Decode(&payload)
+		if err != nil {
+			return fmt.Errorf("decoding job payload: %w", err)
+		}
+		return fn(ctx, payload)
+	}
+}
+
+func (app *application) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobSendEmail:          typedJob(app.sendEmailJob),
+		jobMagicLink:          typedJob(app.magicLinkJob),
+		jobActivationToken:    typedJob(app.activationTokenJob),
+		jobPasswordResetToken: typedJob(app.passwordResetTokenJob),
+	}
+}
+
+func (app *application) enqueueJob(kind string, payload any) error {
+	job, err := app.extended.Jobs.Enqueue(kind, payload, app.config.jobs.maxAttempts)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("job enqueued", "id", job.ID, "kind", job.Kind)
+	return nil
+}
+
+type sendEmailPayload struct {
+	Recipient string         `json:"recipient"`
+	Template  string         `json:"template"`
+	Data      map[string]any `json:"data"`
+}
+
+func (app *application) enqueueEmail(recipient, template string, data map[string]any) error {
+	return app.enqueueJob(jobSendEmail, sendEmailPayload{
+		Recipient: recipient,
+		Template:  template,
+		Data:      data,
+	})
+}
+
+func (app *application) sendEmailJob(ctx context.Context, payload sendEmailPayload) error {
+	return app.mailer.Send(payload.Recipient, payload.Template, payload.Data)
+}
+
+// startWorkers launches the worker pool. Workers stop picking up new jobs
+// once ctx is cancelled, and any job already running is allowed to finish
+// before the worker returns and releases app.wg.
+func (app *application) startWorkers(ctx context.Context) {
+	handlers := app.jobHandlers()
+
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.runWorker(ctx, handlers)
+		}()
+	}
+}
+
+func (app *application) runWorker(ctx context.Context, handlers map[string]jobHandler) {
+	ticker := time.NewTicker(app.config.jobs.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			if !app.runNextJob(handlers) {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) runNextJob(handlers map[string]jobHandler) bool {
+	job, err := app.extended.Jobs.Dequeue(app.config.jobs.lease)
+	if err != nil {
+		if !errors.Is(err, extended.ErrRecordNotFound) {
+			app.logger.Error(err.Error())
+		}
+		return false
+	}
+
+	err = app.executeJob(job, handlers)
+	if err != nil {
+		retryIn := jobBackoff(job.Attempts)
+
+		app.logger.Error(err.Error(), "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+
+		err = app.extended.Jobs.Fail(job, err, retryIn)
+		if err != nil {
+			app.logJobUpdateError(job, err)
+			return true
+		}
+		if job.Status == extended.JobDead {
+			app.logger.Warn("job moved to dead-letter state", "job_id", job.ID, "kind", job.Kind)
+		}
+		return true
+	}
+
+	err = app.extended.Jobs.Complete(job)
+	if err != nil {
+		app.logJobUpdateError(job, err)
+	}
+	return true
+}
+
+// logJobUpdateError reports a failure to record a job's outcome. A lost lease
+// means the job ran past it and another attempt now owns the job, whose
+// status is left alone.
+func (app *application) logJobUpdateError(job *extended.Job, err error) {
+	if errors.Is(err, extended.ErrLeaseLost) {
+		app.logger.Warn("job ran past its lease", "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+		return
+	}
+
+	app.logger.Error(err.Error(), "job_id", job.ID)
+}
+
+func (app *application) executeJob(job *extended.Job, handlers map[string]jobHandler) (err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			err = fmt.Errorf("job panicked: %v", pv)
+		}
+	}()
+
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler registered for job kind %q", job.Kind)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.jobs.lease)
+	defer cancel()
+
+	return handler(ctx, job.Payload)
+}
+
+// jobBackoff returns the delay before the next attempt: 5s, 10s, 20s, ...
+// capped at one hour.
+func jobBackoff(attempts int) time.Duration {
+	backoff := 5 * time.Second
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	return min(backoff, time.Hour)
+}
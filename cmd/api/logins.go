@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/tomasen/realip"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (app *application) loginPolicy(key string) extended.LoginPolicy {
+	policy := extended.LoginPolicy{
+		FreeAttempts:    app.config.login.freeAttempts,
+		MaxFailures:     app.config.login.maxFailures,
+		BaseDelay:       app.config.login.baseDelay,
+		LockoutDuration: app.config.login.lockoutDuration,
+	}
+
+	// Many users can share an address behind NAT, so an IP gets
+	// proportionally more attempts than a single account.
+	if strings.HasPrefix(key, extended.LoginIPKey("")) {
+		scale := app.config.login.ipMaxFailures / max(app.config.login.maxFailures, 1)
+		policy.FreeAttempts *= max(scale, 1)
+		policy.MaxFailures = app.config.login.ipMaxFailures
+	}
+
+	return policy
+}
+
+// loginRetryAfter returns how long the client must wait before it may try to
+// log in as email again, taking the longest wait of the email and IP address.
+func (app *application) loginRetryAfter(r *http.Request, email string) (time.Duration, error) {
+	failures, err := app.extended.LoginFailures.GetAll(extended.LoginEmailKey(email), extended.LoginIPKey(realip.FromRequest(r)))
+	if err != nil {
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	now := time.Now()
+
+	for _, f := range failures {
+		retryAfter = max(retryAfter, app.loginPolicy(f.Key).RetryAfter(f, now))
+	}
+
+	return retryAfter, nil
+}
+
+// recordLoginFailure counts a failed attempt against both the email and the
+// client's IP address. Failures for unknown emails are tracked too, so the
+// response does not reveal whether an account exists; the lockout notice is
+// only sent when user is a real account.
+func (app *application) recordLoginFailure(r *http.Request, email string, user *models.User) {
+	ip := realip.FromRequest(r)
+
+	for _, key := range []string{extended.LoginEmailKey(email), extended.LoginIPKey(ip)} {
+		policy := app.loginPolicy(key)
+
+		f, locked, err := app.extended.LoginFailures.Record(key, policy.MaxFailures, policy.LockoutDuration)
+		if err != nil {
+			app.logError(r, err)
+			continue
+		}
+
+		if !locked {
+			continue
+		}
+
+		app.logger.Warn("login locked out", "key", key, "failures", f.Failures, "ip", ip)
+
+		if user != nil && key == extended.LoginEmailKey(email) {
+			data := map[string]any{
+				"failures":    f.Failures,
+				"ip":          ip,
+				"lockedUntil": f.LockedUntil.UTC().Format(time.RFC1123),
+			}
+
+			err = app.enqueueEmail(user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+	}
+}
+
+// resetLoginFailures clears the failures counted against email after a
+// successful login. The IP address's record is left to expire: anyone with an
+// account of their own could otherwise log into it between guesses at other
+// accounts and wipe the count for their address.
+func (app *application) resetLoginFailures(email string) error {
+	return app.extended.LoginFailures.Reset(extended.LoginEmailKey(email))
+}
+
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.extended.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.extended.LoginFailures.Reset(extended.LoginEmailKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("login lockout cleared", "user_id", user.ID, "by", app.contextGetUser(r).ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"github.com/tomasen/realip"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobMagicLink = "magic_link"
+
+	magicLinkTTL = 15 * time.Minute
+)
+
+// keyedLimiters holds a token bucket per key. Unlike the rateLimit
+// middleware it limits by whatever key the caller chooses, such as an email
+// address that may or may not belong to an account.
+type keyedLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*keyedLimiter
+}
+
+type keyedLimiter struct {
+	limiter *rate.Limiter
+	// idleAt is when the bucket will have refilled completely, after which
+	// forgetting the key loses nothing.
+	idleAt time.Time
+}
+
+const maxKeyedLimiters = 10_000
+
+func (kl *keyedLimiters) allow(key string, every time.Duration, burst int) bool {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	now := time.Now()
+
+	if kl.limiters == nil {
+		kl.limiters = make(map[string]*keyedLimiter)
+	}
+
+	l, found := kl.limiters[key]
+	if !found {
+		if len(kl.limiters) >= maxKeyedLimiters {
+			kl.evict(now)
+		}
+
+		l = &keyedLimiter{limiter: rate.NewLimiter(rate.Every(every), burst)}
+		kl.limiters[key] = l
+	}
+
+	l.idleAt = now.Add(every * time.Duration(burst))
+
+	return l.limiter.Allow()
+}
+
+// evict makes room for a new key. It drops every bucket that has refilled,
+// and only if none has, the one that will be idle soonest, which is the least
+// recently used among buckets of the same rate. It must be called with kl.mu
+// held.
+func (kl *keyedLimiters) evict(now time.Time) {
+	var oldest string
+
+	for key, l := range kl.limiters {
+		if !now.Before(l.idleAt) {
+			delete(kl.limiters, key)
+			continue
+		}
+
+		if oldest == "" || l.idleAt.Before(kl.limiters[oldest].idleAt) {
+			oldest = key
+		}
+	}
+
+	if len(kl.limiters) >= maxKeyedLimiters {
+		delete(kl.limiters, oldest)
+	}
+}
+
+type magicLinkPayload struct {
+	Email string `json:"email"`
+}
+
+// createMagicLinkTokenHandler answers the same way whether or not the email
+// belongs to an account. The lookup and the email happen in a background job
+// so response times do not give it away either.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emailAllowed := app.magicLinks.allow("email:"+strings.ToLower(input.Email), 5*time.Minute, 3)
+	ipAllowed := app.magicLinks.allow("ip:"+realip.FromRequest(r), 30*time.Second, 10)
+
+	if !emailAllowed || !ipAllowed {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	err = app.enqueueJob(jobMagicLink, magicLinkPayload{Email: input.Email})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "if an account exists for this email address, a login link will be sent to it"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) magicLinkJob(ctx context.Context, payload magicLinkPayload) error {
+	user, err := app.models.Users.GetByEmail(payload.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	// Only the newest link works, so a retried job or a repeated request
+	// never leaves several live login tokens behind.
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeMagicLink, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(user.ID, magicLinkTTL, extended.ScopeMagicLink)
+	if err != nil {
+		return err
+	}
+	app.tokenIssued(user.ID, extended.ScopeMagicLink, "")
+
+	data := map[string]any{
+		"magicLinkToken": token.Plaintext,
+	}
+
+	return app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
+}
+
+func (app *application) verifyMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.extended.Tokens.Consume(extended.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.extended.Users.Get(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.beginLogin(w, r, user)
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
 	"github.com/pistolricks/go-api-template/internal/extended"
-	"github.com/pistolricks/mailer"
+	"github.com/pistolricks/go-api-template/internal/jwt"
+	"github.com/pistolricks/go-api-template/internal/mailer"
+	"github.com/pistolricks/go-api-template/internal/oidc"
+	"github.com/pistolricks/go-api-template/internal/password"
+	"github.com/pistolricks/go-api-template/internal/policy"
 	"github.com/pistolricks/models/cmd/models"
 
 	"log/slog"
@@ -26,9 +31,10 @@ import (
 const version = "0.1.0"
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port    int
+	env     string
+	baseURL string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -49,15 +55,71 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	auth struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+		tokenMode  string
+		jwtKeyDir  string
+		jwtKid     string
+		cacheTTL   time.Duration
+		cacheSize  int
+		// permissionCacheTTL bounds how long another instance can act on
+		// permissions that have since been revoked.
+		permissionCacheTTL time.Duration
+	}
+	login struct {
+		freeAttempts    int
+		maxFailures     int
+		ipMaxFailures   int
+		baseDelay       time.Duration
+		lockoutDuration time.Duration
+	}
+	mfa struct {
+		issuer string
+	}
+	password struct {
+		minEntropy   float64
+		breachedFile string
+	}
+	oidc struct {
+		providers []oidc.Config
+	}
+	tokens struct {
+		maxPerScope  int
+		reapInterval time.Duration
+		reapBatch    int
+	}
+	accounts struct {
+		deletionGrace time.Duration
+		purgeInterval time.Duration
+	}
+	policy struct {
+		file string
+	}
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+		lease        time.Duration
+		maxAttempts  int
+	}
 }
 
 type application struct {
-	config   config
-	logger   *slog.Logger
-	models   models.Models
-	extended extended.Extended
-	mailer   mailer.Mailer
-	wg       sync.WaitGroup
+	config          config
+	logger          *slog.Logger
+	models          models.Models
+	extended        extended.Extended
+	mailer          mailer.Mailer
+	jwtKeys         *jwt.KeySet
+	revocations     *revocationList
+	authCache       *authCache
+	permissionCache *permissionCache
+	policy          *policy.Policy
+	oidc            map[string]*oidc.Provider
+	passwords       password.Policy
+	sessions        sessionTouches
+	magicLinks      keyedLimiters
+	wg              sync.WaitGroup
 }
 
 func main() {
@@ -65,6 +127,7 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4000", "Public URL of the API, used in links sent by email")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
@@ -86,7 +149,57 @@ func main() {
 		return nil
 	})
 
+	flag.DurationVar(&cfg.auth.accessTTL, "auth-access-ttl", 15*time.Minute, "Authentication (access) token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTTL, "auth-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	cfg.auth.tokenMode = "db"
+	flag.Func("auth-token-mode", "Access token type (db|jwt)", func(val string) error {
+		if val != "db" && val != "jwt" {
+			return errors.New(`must be "db" or "jwt"`)
+		}
+		cfg.auth.tokenMode = val
+		return nil
+	})
+	flag.StringVar(&cfg.auth.jwtKeyDir, "jwt-key-dir", "", "Directory of JWT signing and verification keys")
+	flag.StringVar(&cfg.auth.jwtKid, "jwt-kid", "", "Key ID to sign new JWTs with (defaults to the last in the key directory)")
+	flag.DurationVar(&cfg.auth.cacheTTL, "auth-cache-ttl", 30*time.Second, "How long an authenticated token's user is cached (0 disables the cache)")
+	flag.IntVar(&cfg.auth.cacheSize, "auth-cache-size", 10000, "Maximum number of tokens in the authentication cache")
+	flag.DurationVar(&cfg.auth.permissionCacheTTL, "auth-permission-cache-ttl", 5*time.Second, "How long a user's effective permissions are cached (0 disables the cache)")
+
+	flag.IntVar(&cfg.login.freeAttempts, "login-free-attempts", 3, "Failed logins allowed before backoff starts")
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins for an email before it is locked out")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 50, "Failed logins from an IP address before it is locked out")
+	flag.DurationVar(&cfg.login.baseDelay, "login-base-delay", time.Second, "Initial login backoff delay")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "Login lockout duration")
+
+	flag.StringVar(&cfg.mfa.issuer, "mfa-issuer", "TEAM", "Issuer name shown in authenticator apps")
+
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", 40, "Minimum estimated password entropy in bits")
+	flag.StringVar(&cfg.policy.file, "policy-file", "", "JSON file of authorization policy rules (defaults to the built-in policies.json)")
+	flag.StringVar(&cfg.password.breachedFile, "password-breached-file", "", "Sorted SHA-1 breached password list (disabled if empty)")
+
+	flag.Func("oidc-provider", "OpenID Connect provider as space separated key=value pairs: name, issuer, client-id, client-secret, redirect-uri, scopes (repeatable)", func(val string) error {
+		provider, err := oidc.ParseConfig(val)
+		if err != nil {
+			return err
+		}
+		cfg.oidc.providers = append(cfg.oidc.providers, provider)
+		return nil
+	})
+
+	flag.IntVar(&cfg.tokens.maxPerScope, "tokens-max-per-scope", 25, "Outstanding tokens a user may hold per scope before the oldest are evicted")
+	flag.DurationVar(&cfg.tokens.reapInterval, "tokens-reap-interval", 10*time.Minute, "How often expired tokens are deleted")
+	flag.IntVar(&cfg.tokens.reapBatch, "tokens-reap-batch", 1000, "Expired tokens deleted per batch")
+
+	flag.DurationVar(&cfg.accounts.deletionGrace, "accounts-deletion-grace", 30*24*time.Hour, "Time a deleted account can still be restored before it is purged")
+	flag.DurationVar(&cfg.accounts.purgeInterval, "accounts-purge-interval", time.Hour, "How often accounts past their deletion grace period are purged")
+
+	flag.IntVar(&cfg.jobs.workers, "jobs-workers", 4, "Number of background job workers")
+	flag.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "Background job queue poll interval")
+	flag.DurationVar(&cfg.jobs.lease, "jobs-lease", 5*time.Minute, "Time a running job may take before it is retried")
+	flag.IntVar(&cfg.jobs.maxAttempts, "jobs-max-attempts", 5, "Attempts before a background job is dead-lettered")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
+	bootstrapAdmin := flag.String("bootstrap-admin", "", "Grant permissions:admin to the user with this email and exit")
 
 	flag.Parse()
 
@@ -124,11 +237,70 @@ func main() {
 	}))
 
 	app := &application{
-		config:   cfg,
-		logger:   logger,
-		models:   models.NewModels(db),
-		extended: extended.NewExtended(db),
-		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:          cfg,
+		logger:          logger,
+		models:          models.NewModels(db),
+		extended:        extended.NewExtended(db),
+		mailer:          mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		authCache:       newAuthCache(cfg.auth.cacheTTL, cfg.auth.cacheSize),
+		permissionCache: newPermissionCache(cfg.auth.permissionCacheTTL, cfg.auth.cacheSize),
+	}
+
+	if *bootstrapAdmin != "" {
+		err = app.bootstrapAdmin(*bootstrapAdmin)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("granted "+permissionsAdmin, "email", *bootstrapAdmin)
+		return
+	}
+
+	if cfg.policy.file != "" {
+		app.policy, err = policy.Load(cfg.policy.file)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("loaded authorization policy", "file", cfg.policy.file)
+	} else {
+		app.policy = defaultPolicy
+	}
+
+	app.passwords.MinEntropy = cfg.password.minEntropy
+	if cfg.password.breachedFile != "" {
+		app.passwords.Breached, err = password.OpenBreachedList(cfg.password.breachedFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer app.passwords.Breached.Close()
+
+		logger.Info("checking passwords against breached list", "file", cfg.password.breachedFile)
+	}
+
+	app.oidc = make(map[string]*oidc.Provider)
+	for _, provider := range cfg.oidc.providers {
+		app.oidc[provider.Name] = oidc.NewProvider(provider)
+	}
+
+	if cfg.auth.tokenMode == "jwt" {
+		app.jwtKeys, err = jwt.LoadKeyDir(cfg.auth.jwtKeyDir, cfg.auth.jwtKid)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		app.revocations = &revocationList{}
+		err = app.syncRevocations()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("issuing JWT access tokens", "key_dir", cfg.auth.jwtKeyDir)
 	}
 
 	err = app.serve()
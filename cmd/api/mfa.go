@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/totp"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"github.com/skip2/go-qrcode"
+	"net/http"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.extended.MFA.SetTOTP(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrEditConflict):
+			app.mfaAlreadyEnabledResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	uri := totp.URI(app.config.mfa.issuer, user.Email, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"totp": map[string]string{
+			"secret":      secret,
+			"otpauth_uri": uri,
+			"qr_code_png": base64.StdEncoding.EncodeToString(png),
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	v := validation.New()
+
+	enrolment, err := app.extended.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("code", "no two-factor enrolment in progress")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrolment.Confirmed {
+		app.mfaAlreadyEnabledResponse(w, r)
+		return
+	}
+
+	if !app.checkTOTP(w, r, enrolment, input.Code, true) {
+		return
+	}
+
+	app.issueRecoveryCodes(w, r, user.ID, http.StatusOK)
+}
+
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(app.contextGetUser(r).Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	enrolment, err := app.extended.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrolment.Confirmed && !app.checkTOTP(w, r, enrolment, input.Code, false) {
+		return
+	}
+
+	err = app.extended.MFA.DeleteTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrolment, err := app.extended.MFA.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enrolment == nil || !enrolment.Confirmed {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if !app.checkTOTP(w, r, enrolment, input.Code, false) {
+		return
+	}
+
+	app.issueRecoveryCodes(w, r, user.ID, http.StatusCreated)
+}
+
+// verifyMFAHandler completes the second step of a two-factor login by
+// exchanging an MFA challenge token plus a TOTP or recovery code for a new
+// session.
+func (app *application) verifyMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"mfa_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	models.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(extended.ScopeMFAChallenge, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	retryAfter, err := app.loginRetryAfter(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+
+	if input.RecoveryCode != "" {
+		ok, err := app.extended.MFA.UseRecoveryCode(user.ID, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.recordLoginFailure(r, user.Email, user)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	} else {
+		enrolment, err := app.extended.MFA.GetTOTP(user.ID)
+		if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Two-factor was turned off since the challenge was issued, and
+		// perhaps enrolled again without being confirmed, so the challenge
+		// no longer stands; the client has to log in again.
+		if enrolment == nil || !enrolment.Confirmed {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		ok, err := app.validTOTP(enrolment, input.Code, false)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.recordLoginFailure(r, user.Email, user)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	err = app.resetLoginFailures(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeMFAChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// checkTOTP validates code against the enrolment and marks its time step as
+// used. It writes the error response itself and reports whether the caller
+// may carry on.
+func (app *application) checkTOTP(w http.ResponseWriter, r *http.Request, enrolment *extended.TOTP, code string, confirm bool) bool {
+	ok, err := app.validTOTP(enrolment, code, confirm)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		v := validation.New()
+		v.AddError("code", "invalid or already used code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// validTOTP reports whether code is valid for enrolment and has not been used
+// before, recording its time step as used if so.
+func (app *application) validTOTP(enrolment *extended.TOTP, code string, confirm bool) (bool, error) {
+	step, ok := totp.Validate(enrolment.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.extended.MFA.UseStep(enrolment.UserID, step, confirm)
+}
+
+func (app *application) issueRecoveryCodes(w http.ResponseWriter, r *http.Request, userID int64, status int) {
+	codes, err := extended.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.extended.MFA.ReplaceRecoveryCodes(userID, codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"message":        "store these recovery codes somewhere safe, they will not be shown again",
+		"recovery_codes": codes,
+	}
+
+	err = app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
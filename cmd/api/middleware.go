@@ -6,6 +6,8 @@ import (
 	"expvar"
 	"fmt"
 	"github.com/devedge/imagehash"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/jwt"
 	"github.com/pistolricks/models/cmd/models"
 	"github.com/pistolricks/validation"
 	"github.com/tomasen/realip"
@@ -84,22 +86,54 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		authorizationHeader := r.Header.Get("Authorization")
+		apiKeyHeader := r.Header.Get("X-API-Key")
 
-		if authorizationHeader == "" {
+		if authorizationHeader == "" && apiKeyHeader == "" {
 			r = app.contextSetUser(r, models.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if apiKeyHeader != "" {
+			app.authenticateAPIKey(w, r, next, apiKeyHeader)
+			return
+		}
+
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
 		token := headerParts[1]
+
+		if app.jwtKeys != nil && jwt.LooksLikeJWT(token) {
+			claims, err := app.jwtKeys.Verify(token, time.Now())
+			if err != nil || app.revocations.includes(claims) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, userFromClaims(claims))
+			r = app.contextSetToken(r, token)
+			app.touchSession(r, claims)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(token, extended.OAuthAccessTokenPrefix) {
+			app.authenticateOAuth(w, r, next, token)
+			return
+		}
+
 		v := validation.New()
 
 		if models.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -107,7 +141,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(models.ScopeAuthentication, token)
+		user, err := app.authCache.get(token, func() (*models.User, error) {
+			return app.models.Users.GetForToken(models.ScopeAuthentication, token)
+		})
 		if err != nil {
 			switch {
 			case errors.Is(err, models.ErrRecordNotFound):
@@ -119,10 +155,60 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+		app.touchSession(r, nil)
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	key, user, err := app.extended.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidAPIKey):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.sessions.due("apikey:" + key.Prefix) {
+		err = app.extended.APIKeys.Touch(key.ID)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetScopes(r, key.Permissions)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateOAuth authenticates an access token issued to a third-party
+// client, limiting the request to the scopes the user granted that client.
+func (app *application) authenticateOAuth(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	grant, user, err := app.extended.OAuth.GetToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if grant.Scope != extended.ScopeOAuthAccess {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetScopes(r, grant.Permissions)
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -146,28 +232,68 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireSessionUser is requireActivatedUser for endpoints that manage
+// credentials, which a delegated credential must not be able to reach.
+func (app *application) requireSessionUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetScopes(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAllPermissions([]string{code}, next)
+}
+
+// requireAllPermissions lets the request through only if the user holds every
+// one of codes. Delegated credentials must also have been granted each code.
+func (app *application) requireAllPermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.contextGetPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		if !permissions.Include(code) {
-			app.notPermittedResponse(w, r)
-			return
-		}
 
-		/* Test require Permission - This was to check to see if context was working and attaching the user to the permission*/
+		scopes := app.contextGetScopes(r)
 
-		// err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
-		// if err != nil {
-		// 	app.serverErrorResponse(w, r, err)
-		// }
+		for _, code := range codes {
+			if !extended.PermissionGranted(permissions, code) || (scopes != nil && !extended.PermissionGranted(scopes, code)) {
+				app.notPermittedResponse(w, r)
+				return
+			}
+		}
 
 		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
+// requireAnyPermission lets the request through if the user holds at least
+// one of codes, and for delegated credentials the same code is in scope.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.contextGetPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		scopes := app.contextGetScopes(r)
+
+		for _, code := range codes {
+			if extended.PermissionGranted(permissions, code) && (scopes == nil || extended.PermissionGranted(scopes, code)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
 
+		app.notPermittedResponse(w, r)
 	}
 
 	return app.requireActivatedUser(fn)
@@ -186,7 +312,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
 						w.WriteHeader(http.StatusOK)
 						return
 					}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const oauthCodeTTL = 10 * time.Minute
+
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	granted, err := app.contextGetPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	client, err := extended.GenerateOAuthClient(user.ID, input.Name, input.RedirectURIs, input.Scopes, !input.Public)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidateOAuthClient(v, client, granted); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/oauth/clients/%d", client.ID))
+
+	env := envelope{"client": client}
+	if client.Confidential() {
+		env["message"] = "store the client secret somewhere safe, it will not be shown again"
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.extended.OAuth.GetAllClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.extended.OAuth.DeleteClient(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client and all of its tokens successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// authorization is a checked authorization request: the client, where to
+// send the user back to, and the permission codes the user can delegate.
+type authorization struct {
+	client      *extended.OAuthClient
+	redirectURI string
+	scopes      models.Permissions
+}
+
+// checkAuthorizeRequest validates an authorization request on behalf of the
+// consent UI. Problems with the client or redirect URI are reported directly,
+// since sending the user to an unverified URI would make this an open
+// redirect; anything else is reported back to the client through the
+// redirect URI as RFC 6749 section 4.1.2.1 requires. It writes the response
+// itself whenever it returns false.
+func (app *application) checkAuthorizeRequest(w http.ResponseWriter, r *http.Request, req authorizeRequest) (*authorization, bool) {
+	client, err := app.extended.OAuth.GetClient(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidClient):
+			app.badRequestResponse(w, r, errors.New("unknown client_id"))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	if !client.HasRedirectURI(redirectURI) {
+		app.badRequestResponse(w, r, errors.New("redirect_uri is not registered for this client"))
+		return nil, false
+	}
+
+	fail := func(code, description string) (*authorization, bool) {
+		app.oauthRedirect(w, r, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {req.State},
+		})
+		return nil, false
+	}
+
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "response_type must be code")
+	}
+
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "a PKCE code_challenge with code_challenge_method S256 is required")
+	}
+
+	requested := extended.ParseOAuthScope(req.Scope)
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+
+	granted, err := app.contextGetPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	var scopes models.Permissions
+	for _, code := range requested {
+		if !extended.PermissionGranted(client.Scopes, code) {
+			return fail("invalid_scope", fmt.Sprintf("scope %q is not allowed for this client", code))
+		}
+		if extended.PermissionGranted(granted, code) && !scopes.Include(code) {
+			scopes = append(scopes, code)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return fail("invalid_scope", "you do not hold any of the requested permissions")
+	}
+
+	return &authorization{client: client, redirectURI: redirectURI, scopes: scopes}, true
+}
+
+// oauthRedirect tells the consent UI where to send the user next. The API is
+// called with a bearer token rather than a browser cookie, so it answers with
+// the URI instead of a 302 the UI could not observe.
+func (app *application) oauthRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	q := u.Query()
+	for key, values := range params {
+		if values[0] != "" {
+			q.Set(key, values[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_to": u.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showAuthorizeHandler returns what the user is being asked to consent to.
+func (app *application) showAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := authorizeRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+
+	auth, ok := app.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	env := envelope{
+		"consent": map[string]any{
+			"client": map[string]string{
+				"client_id": auth.client.ClientID,
+				"name":      auth.client.Name,
+			},
+			"scopes":       auth.scopes,
+			"redirect_uri": auth.redirectURI,
+		},
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeHandler records the user's consent decision and hands back the
+// redirect carrying either an authorization code or an access_denied error.
+func (app *application) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizeRequest
+		Approve bool `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	auth, ok := app.checkAuthorizeRequest(w, r, input.authorizeRequest)
+	if !ok {
+		return
+	}
+
+	if !input.Approve {
+		app.oauthRedirect(w, r, auth.redirectURI, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"the user denied the request"},
+			"state":             {input.State},
+		})
+		return
+	}
+
+	family, err := extended.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	code, err := app.extended.OAuth.NewToken(&extended.OAuthGrant{
+		Scope:         extended.ScopeOAuthCode,
+		UserID:        app.contextGetUser(r).ID,
+		ClientID:      auth.client.ClientID,
+		Permissions:   auth.scopes,
+		Expiry:        time.Now().Add(oauthCodeTTL),
+		Family:        family,
+		RedirectURI:   input.RedirectURI,
+		CodeChallenge: input.CodeChallenge,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenIssued(app.contextGetUser(r).ID, extended.ScopeOAuthCode, auth.client.ClientID)
+
+	app.oauthRedirect(w, r, auth.redirectURI, url.Values{
+		"code":  {code},
+		"state": {input.State},
+	})
+}
+
+// authenticateOAuthClient parses the form body of a token, introspection or
+// revocation request and authenticates the client with HTTP Basic or with
+// client_id and client_secret form fields. It writes the response itself
+// whenever it returns false.
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*extended.OAuthClient, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "body must be application/x-www-form-urlencoded")
+		return nil, false
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes the credentials before
+		// they go into the Authorization header.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.extended.OAuth.GetClient(clientID)
+	if err != nil && !errors.Is(err, extended.ErrInvalidClient) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if client == nil || !client.Authenticate(secret) {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+
+	return client, true
+}
+
+func (app *application) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		app.authorizationCodeGrant(w, r, client)
+	case "refresh_token":
+		app.refreshTokenGrant(w, r, client)
+	case "client_credentials":
+		app.clientCredentialsGrant(w, r, client)
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func (app *application) authorizationCodeGrant(w http.ResponseWriter, r *http.Request, client *extended.OAuthClient) {
+	grant, ok := app.redeemOAuthToken(w, r, extended.ScopeOAuthCode, client, r.PostForm.Get("code"))
+	if !ok {
+		return
+	}
+
+	if grant.RedirectURI != "" && grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+
+	verifier := r.PostForm.Get("code_verifier")
+	challenge := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(challenge[:])
+
+	if len(verifier) < 43 || len(verifier) > 128 || subtle.ConstantTimeCompare([]byte(expected), []byte(grant.CodeChallenge)) != 1 {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+
+	app.issueOAuthTokens(w, r, grant, true)
+}
+
+func (app *application) refreshTokenGrant(w http.ResponseWriter, r *http.Request, client *extended.OAuthClient) {
+	grant, ok := app.redeemOAuthToken(w, r, extended.ScopeOAuthRefresh, client, r.PostForm.Get("refresh_token"))
+	if !ok {
+		return
+	}
+
+	// A client may ask for fewer scopes than it was originally granted,
+	// never more.
+	if requested := extended.ParseOAuthScope(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, code := range requested {
+			if !extended.PermissionGranted(grant.Permissions, code) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %q was not granted", code))
+				return
+			}
+		}
+		grant.Permissions = requested
+	}
+
+	app.issueOAuthTokens(w, r, grant, true)
+}
+
+// clientCredentialsGrant lets a confidential client act as itself. Its
+// tokens belong to the user who registered it, limited to the client's
+// scopes and to the permissions that user still holds.
+func (app *application) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client *extended.OAuthClient) {
+	if !client.Confidential() {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients cannot use the client_credentials grant")
+		return
+	}
+
+	requested := extended.ParseOAuthScope(r.PostForm.Get("scope"))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+
+	granted, err := app.extended.Permissions.GetAllForUser(client.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var scopes models.Permissions
+	for _, code := range requested {
+		if !extended.PermissionGranted(client.Scopes, code) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %q is not allowed for this client", code))
+			return
+		}
+		if extended.PermissionGranted(granted, code) && !scopes.Include(code) {
+			scopes = append(scopes, code)
+		}
+	}
+
+	if len(scopes) == 0 {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the client owner does not hold any of the requested permissions")
+		return
+	}
+
+	family, err := extended.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	grant := &extended.OAuthGrant{
+		UserID:      client.UserID,
+		ClientID:    client.ClientID,
+		Permissions: scopes,
+		Family:      family,
+	}
+
+	app.issueOAuthTokens(w, r, grant, false)
+}
+
+// redeemOAuthToken consumes a single-use code or refresh token. It writes the
+// response itself whenever it returns false.
+func (app *application) redeemOAuthToken(w http.ResponseWriter, r *http.Request, scope string, client *extended.OAuthClient, plaintext string) (*extended.OAuthGrant, bool) {
+	if plaintext == "" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "missing "+scopeParam(scope))
+		return nil, false
+	}
+
+	grant, err := app.extended.OAuth.UseToken(scope, client.ClientID, plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrTokenReused):
+			app.logger.Warn("oauth token reused, revoking token family", "client_id", client.ClientID, "scope", scope)
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", scopeParam(scope)+" has already been used")
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", scopeParam(scope)+" is invalid or expired")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return grant, true
+}
+
+func scopeParam(scope string) string {
+	if scope == extended.ScopeOAuthCode {
+		return "code"
+	}
+	return "refresh_token"
+}
+
+// issueOAuthTokens writes an RFC 6749 section 5.1 token response for grant,
+// with a rotated refresh token in the same family when refresh is set.
+func (app *application) issueOAuthTokens(w http.ResponseWriter, r *http.Request, grant *extended.OAuthGrant, refresh bool) {
+	grant.Scope = extended.ScopeOAuthAccess
+	grant.Expiry = time.Now().Add(app.config.auth.accessTTL)
+	grant.RedirectURI = ""
+	grant.CodeChallenge = ""
+
+	accessToken, err := app.extended.OAuth.NewToken(grant)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokenIssued(grant.UserID, grant.Scope, grant.ClientID)
+
+	env := envelope{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.auth.accessTTL.Seconds()),
+		"scope":        strings.Join(grant.Permissions, " "),
+	}
+
+	if refresh {
+		grant.Scope = extended.ScopeOAuthRefresh
+		grant.Expiry = time.Now().Add(app.config.auth.refreshTTL)
+
+		env["refresh_token"], err = app.extended.OAuth.NewToken(grant)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.tokenIssued(grant.UserID, grant.Scope, grant.ClientID)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthIntrospectHandler implements RFC 7662. A client may only introspect
+// its own tokens; anything else is reported as inactive.
+func (app *application) oauthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	if !client.Confidential() {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "public clients cannot introspect tokens")
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	grant, user, err := app.extended.OAuth.GetToken(r.PostForm.Get("token"))
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"active": false}
+
+	if grant != nil && grant.ClientID == client.ClientID {
+		tokenType := "Bearer"
+		if grant.Scope == extended.ScopeOAuthRefresh {
+			tokenType = "refresh_token"
+		}
+
+		env = envelope{
+			"active":     true,
+			"scope":      strings.Join(grant.Permissions, " "),
+			"client_id":  grant.ClientID,
+			"username":   user.Email,
+			"sub":        strconv.FormatInt(user.ID, 10),
+			"exp":        grant.Expiry.Unix(),
+			"token_type": tokenType,
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthRevokeHandler implements RFC 7009. Unknown tokens and tokens issued to
+// other clients are silently ignored, as the RFC requires.
+func (app *application) oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "missing token")
+		return
+	}
+
+	err := app.extended.OAuth.DeleteToken(client.ClientID, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/oidc"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+func (app *application) readProviderParam(r *http.Request) (*oidc.Provider, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+
+	provider, ok := app.oidc[name]
+	return provider, ok
+}
+
+func (app *application) listOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := make([]string, 0, len(app.oidc))
+	for name := range app.oidc {
+		providers = append(providers, name)
+	}
+	slices.Sort(providers)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"providers": providers}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcAuthorizeHandler starts a federated login. The client sends the user to
+// the returned URL and should keep the state to compare with the one the
+// provider hands back to its redirect URI.
+func (app *application) oidcAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var state extended.OIDCState
+	var err error
+
+	for _, value := range []*string{&state.State, &state.Nonce, &state.CodeVerifier} {
+		*value, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	state.Provider = provider.Name
+	state.Expiry = time.Now().Add(oidcStateTTL)
+
+	authorizationURL, err := provider.AuthCodeURL(r.Context(), state.State, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.extended.Identities.InsertState(&state)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization_url": authorizationURL, "state": state.State}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcCallbackHandler finishes a federated login with the code and state the
+// provider sent to the client's redirect URI. The identity is matched to an
+// account by its provider subject, or linked on first use to the account
+// with the same email if the provider says the email is verified.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	state, err := app.extended.Identities.UseState(provider.Name, input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(r.Context(), input.Code, state.CodeVerifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchange):
+			app.logger.Warn("oidc code exchange failed", "provider", provider.Name, "error", err.Error())
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	idToken, err := provider.Verify(r.Context(), rawIDToken, state.Nonce, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.Warn("oidc id token rejected", "provider", provider.Name)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.extended.Identities.GetUser(provider.Name, idToken.Subject)
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user == nil {
+		if !idToken.EmailVerified || idToken.Email == "" {
+			app.unlinkedIdentityResponse(w, r)
+			return
+		}
+
+		user, err = app.models.Users.GetByEmail(idToken.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrRecordNotFound):
+				app.unlinkedIdentityResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.extended.Identities.Link(user.ID, provider.Name, idToken.Subject, idToken.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logger.Info("linked oidc identity", "provider", provider.Name, "user_id", user.ID)
+	}
+
+	app.beginLogin(w, r, user)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed "templates"
+var pageFS embed.FS
+
+var pages = template.Must(template.ParseFS(pageFS, "templates/*.tmpl"))
+
+// renderPage writes one of the few HTML pages the API serves, for links that
+// are opened in a browser straight from an email. The page is rendered into
+// a buffer first so that a template error still produces a clean 500.
+func (app *application) renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	buf := new(bytes.Buffer)
+
+	err := pages.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// These pages carry tokens in their URL and forms, so keep them out of
+	// caches, Referer headers and other sites' frames.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"expvar"
+	"github.com/pistolricks/models/cmd/models"
+	"golang.org/x/sync/singleflight"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var permissionCacheStats = expvar.NewMap("permission_cache")
+
+// permissionCache holds each user's effective permissions for a short while.
+// Grants and role assignments invalidate the user's entry; changes to a role
+// can affect any number of users and invalidate everything. Other instances
+// of the API only notice a change once ttl has passed.
+type permissionCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[int64]permissionCacheEntry
+	// generation is bumped by every invalidation, as in authCache.
+	generation uint64
+
+	group singleflight.Group
+}
+
+type permissionCacheEntry struct {
+	permissions models.Permissions
+	expires     time.Time
+}
+
+func newPermissionCache(ttl time.Duration, size int) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[int64]permissionCacheEntry),
+	}
+}
+
+// get returns the user's permissions, calling load on a miss. Each caller
+// gets its own copy of the slice.
+func (c *permissionCache) get(userID int64, load func() (models.Permissions, error)) (models.Permissions, error) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return load()
+	}
+
+	c.mu.Lock()
+	entry, found := c.entries[userID]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if found && time.Now().Before(entry.expires) {
+		permissionCacheStats.Add("hits", 1)
+		return slices.Clone(entry.permissions), nil
+	}
+
+	permissionCacheStats.Add("misses", 1)
+
+	// As in authCache, loads are only shared within a generation.
+	key := strconv.FormatInt(userID, 10) + ":" + strconv.FormatUint(generation, 10)
+
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		permissions, err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		c.put(userID, permissions, generation)
+		return permissions, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(v.(models.Permissions)), nil
+}
+
+func (c *permissionCache) put(userID int64, permissions models.Permissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	now := time.Now()
+
+	if len(c.entries) >= c.size {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+
+	for id := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, id)
+		permissionCacheStats.Add("evictions", 1)
+	}
+
+	c.entries[userID] = permissionCacheEntry{permissions: permissions, expires: now.Add(c.ttl)}
+}
+
+func (c *permissionCache) invalidateUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.entries, userID)
+}
+
+func (c *permissionCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+}
+
+// invalidateUser drops everything cached about the user. It is called
+// whenever the user, their credentials or their permissions change.
+func (app *application) invalidateUser(userID int64) {
+	app.authCache.invalidateUser(userID)
+	app.permissionCache.invalidateUser(userID)
+}
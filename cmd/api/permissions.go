@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"github.com/tomasen/realip"
+	"net/http"
+)
+
+const permissionsAdmin = "permissions:admin"
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.extended.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidatePermissionCode(v, "code", input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.Permissions.Insert(input.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrDuplicatePermission):
+			v.AddError("code", "a permission with this code already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.auditPermissions(r, "permission.create", nil, input.Code)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"permission": input.Code}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	v.Check(len(input.Codes) >= 1, "codes", "must contain at least 1 code")
+	v.Check(validation.Unique(input.Codes), "codes", "must not contain duplicate values")
+	for i, code := range input.Codes {
+		extended.ValidatePermissionCode(v, fmt.Sprintf("codes[%d]", i), code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.Permissions.Grant(user.ID, input.Codes...)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("codes", "must only contain existing permission codes")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.invalidateUser(user.ID)
+
+	app.auditPermissions(r, "permission.grant", &user.ID, input.Codes...)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	// The first admin can only be made from the command line, so don't let
+	// an admin lock themselves out by accident, including by revoking a
+	// wildcard such as "permissions:*".
+	if extended.PermissionGranted([]string{code}, permissionsAdmin) && user.ID == app.contextGetUser(r).ID {
+		v := validation.New()
+		v.AddError("code", "you cannot revoke your own "+code)
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.extended.Permissions.Revoke(user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.invalidateUser(user.ID)
+
+	app.auditPermissions(r, "permission.revoke", &user.ID, code)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// bootstrapAdmin grants permissionsAdmin to the user with the given email.
+// It is run from the command line to create the first admin, who can then
+// manage everyone else's permissions through the API.
+func (app *application) bootstrapAdmin(email string) error {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return fmt.Errorf("no user with email %q", email)
+		}
+		return err
+	}
+
+	err = app.extended.Permissions.Grant(user.ID, permissionsAdmin)
+	if err != nil {
+		if errors.Is(err, extended.ErrRecordNotFound) {
+			return fmt.Errorf("permission %q does not exist; run the database migrations first", permissionsAdmin)
+		}
+		return err
+	}
+
+	app.audit(&extended.AuditEvent{
+		Action:  "permission.grant",
+		Outcome: extended.AuditAllowed,
+		UserID:  &user.ID,
+		Details: map[string]any{"codes": []string{permissionsAdmin}, "by": "command line"},
+	})
+
+	return nil
+}
+
+// readUserParam returns the user named by the :id route parameter. It writes
+// the response itself whenever it returns false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.extended.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	permissions, err := app.extended.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) auditPermissions(r *http.Request, action string, userID *int64, codes ...string) {
+	app.audit(&extended.AuditEvent{
+		Action:  action,
+		Outcome: extended.AuditAllowed,
+		UserID:  userID,
+		IP:      realip.FromRequest(r),
+		Details: map[string]any{"codes": codes, "by": app.contextGetUser(r).ID},
+	})
+}
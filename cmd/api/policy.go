@@ -0,0 +1,95 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/policy"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/tomasen/realip"
+	"net/http"
+)
+
+// policies.json is the policy used unless -policy-file names another one.
+//
+//go:embed "policies.json"
+var defaultPolicyJSON []byte
+
+var defaultPolicy = mustParsePolicy(defaultPolicyJSON)
+
+func mustParsePolicy(data []byte) *policy.Policy {
+	p, err := policy.Parse(data)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// scopedPermissions are the user's permissions as far as the credential in
+// use may exercise them.
+type scopedPermissions struct {
+	permissions models.Permissions
+	scopes      models.Permissions
+}
+
+func (p scopedPermissions) Include(code string) bool {
+	return extended.PermissionGranted(p.permissions, code) && (p.scopes == nil || extended.PermissionGranted(p.scopes, code))
+}
+
+// authorize evaluates the policy for the request's user performing action on
+// a resource described by attributes, and records the decision in the audit
+// log. It writes the response itself whenever it returns false.
+//
+// Rules such as "owners may delete their content" need no permission, so a
+// delegated credential is only let through when action itself is in its
+// scopes, whatever the policy says.
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, action string, resource policy.Attributes) bool {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.contextGetPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	scopes := app.contextGetScopes(r)
+
+	var decision policy.Decision
+	if scopes != nil && !extended.PermissionGranted(scopes, action) {
+		decision.Reason = fmt.Sprintf("credential is not scoped for %s", action)
+	} else {
+		decision = app.policy.Evaluate(policy.Request{
+			Subject: policy.Attributes{
+				"id":        user.ID,
+				"owner":     HashID(user.ID),
+				"activated": user.Activated,
+			},
+			Permissions: scopedPermissions{permissions: permissions, scopes: scopes},
+			Action:      action,
+			Resource:    resource,
+		})
+	}
+
+	event := &extended.AuditEvent{
+		Action:  action,
+		Outcome: extended.AuditAllowed,
+		Reason:  decision.Reason,
+		IP:      realip.FromRequest(r),
+		Details: map[string]any{"rule": decision.Rule, "resource": resource},
+	}
+	if !user.IsAnonymous() {
+		event.UserID = &user.ID
+	}
+	if !decision.Allowed {
+		event.Outcome = extended.AuditDenied
+	}
+
+	app.audit(event)
+
+	if !decision.Allowed {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/validation"
+	"net/http"
+)
+
+func (app *application) showProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := app.loadProfile(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateProfileHandler changes only the fields present in the request. An
+// empty avatar_content_id removes the avatar. If version is given it must
+// match the stored profile, so a client editing a stale copy gets a conflict
+// instead of silently overwriting someone else's change.
+func (app *application) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := app.loadProfile(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		DisplayName     *string `json:"display_name"`
+		Locale          *string `json:"locale"`
+		Timezone        *string `json:"timezone"`
+		AvatarContentID *string `json:"avatar_content_id"`
+		Version         *int    `json:"version"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Version != nil && *input.Version != profile.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Name != nil {
+		profile.Name = *input.Name
+	}
+	if input.DisplayName != nil {
+		profile.DisplayName = *input.DisplayName
+	}
+	if input.Locale != nil {
+		profile.Locale = *input.Locale
+	}
+	if input.Timezone != nil {
+		profile.Timezone = *input.Timezone
+	}
+	if input.AvatarContentID != nil {
+		profile.AvatarContentID = input.AvatarContentID
+		if *input.AvatarContentID == "" {
+			profile.AvatarContentID = nil
+		}
+	}
+
+	v := validation.New()
+
+	if extended.ValidateProfile(v, profile); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.AvatarContentID != nil && profile.AvatarContentID != nil {
+		content, err := app.extended.Contents.Get(*profile.AvatarContentID)
+		if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if content == nil || content.UserID != HashID(profile.ID) {
+			v.AddError("avatar_content_id", "must be one of your uploaded contents")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.extended.Users.UpdateProfile(profile)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("avatar_content_id", "must be one of your uploaded contents")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.invalidateUser(profile.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// loadProfile returns the authenticated user's profile along with their
+// permission codes. It writes the response itself whenever it returns false.
+func (app *application) loadProfile(w http.ResponseWriter, r *http.Request) (*extended.Profile, bool) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.extended.Users.GetProfile(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	profile.Permissions, err = app.contextGetPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	return profile, true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"github.com/pistolricks/models/cmd/models"
+	"time"
+)
+
+var (
+	tokensIssued = expvar.NewMap("tokens_issued_by_scope")
+	tokensReaped = expvar.NewMap("tokens_reaped_by_scope")
+)
+
+// tokenIssued is called after every token is stored. It counts the token and
+// enforces the per-user cap for its scope by evicting the oldest outstanding
+// tokens. clientID is set for OAuth tokens, which are capped per client.
+// Failing to trim is logged rather than failing the request.
+func (app *application) tokenIssued(userID int64, scope, clientID string) {
+	tokensIssued.Add(scope, 1)
+
+	evicted, err := app.extended.Tokens.Trim(userID, scope, clientID, app.config.tokens.maxPerScope)
+	if err != nil {
+		app.logger.Error(err.Error(), "user_id", userID, "scope", scope)
+		return
+	}
+
+	if evicted > 0 {
+		if scope == models.ScopeAuthentication {
+			app.invalidateUser(userID)
+		}
+		app.logger.Info("evicted tokens over per-user cap", "user_id", userID, "scope", scope, "evicted", evicted)
+	}
+}
+
+// startTokenReaper deletes expired tokens, the sessions left without any,
+// stale login failure records and expired JWT revocations every reapInterval
+// until ctx is cancelled.
+func (app *application) startTokenReaper(ctx context.Context) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.tokens.reapInterval)
+		defer ticker.Stop()
+
+		for {
+			app.reapTokens(ctx)
+			app.reapSessions(ctx)
+			app.reapLoginFailures(ctx)
+			app.reapRevocations(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (app *application) reapTokens(ctx context.Context) {
+	batch := app.config.tokens.reapBatch
+
+	var total int64
+
+	for ctx.Err() == nil {
+		deleted, err := app.extended.Tokens.DeleteExpired(batch)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		var n int64
+		for scope, count := range deleted {
+			tokensReaped.Add(scope, count)
+			n += count
+		}
+		total += n
+
+		if n < int64(batch) {
+			break
+		}
+
+		// Give other writers a turn between batches.
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if total > 0 {
+		app.logger.Info("reaped expired tokens", "deleted", total)
+	}
+}
+
+func (app *application) reapSessions(ctx context.Context) {
+	batch := app.config.tokens.reapBatch
+
+	var total int64
+
+	for ctx.Err() == nil {
+		n, err := app.extended.Sessions.DeleteDead(batch)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+		total += n
+
+		if n < int64(batch) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if total > 0 {
+		app.logger.Info("reaped sessions without live tokens", "deleted", total)
+	}
+}
+
+func (app *application) reapLoginFailures(ctx context.Context) {
+	batch := app.config.tokens.reapBatch
+
+	var total int64
+
+	for ctx.Err() == nil {
+		n, err := app.extended.LoginFailures.DeleteStale(batch)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+		total += n
+
+		if n < int64(batch) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if total > 0 {
+		app.logger.Info("reaped stale login failures", "deleted", total)
+	}
+}
+
+func (app *application) reapRevocations(ctx context.Context) {
+	batch := app.config.tokens.reapBatch
+
+	var total int64
+
+	for ctx.Err() == nil {
+		n, err := app.extended.Revocations.DeleteExpired(batch)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+		total += n
+
+		if n < int64(batch) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if total > 0 {
+		app.logger.Info("reaped expired JWT revocations", "deleted", total)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pistolricks/go-api-template/internal/jwt"
+	"github.com/pistolricks/models/cmd/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const revocationSyncInterval = 30 * time.Second
+
+// revocationList is the in-memory copy of the jwt_revocations table. It is
+// consulted on every JWT-authenticated request in place of a database lookup
+// and kept in sync by a periodic reload, so revocations made by other
+// instances take effect within one sync interval.
+type revocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func userRevocationID(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+func familyRevocationID(family string) string {
+	return "family:" + family
+}
+
+func (rl *revocationList) set(revoked map[string]time.Time) {
+	rl.mu.Lock()
+	rl.revoked = revoked
+	rl.mu.Unlock()
+}
+
+func (rl *revocationList) add(id string, revokedAt time.Time) {
+	rl.mu.Lock()
+	rl.revoked[id] = revokedAt
+	rl.mu.Unlock()
+}
+
+// includes reports whether the token itself or its session has been revoked,
+// or it was issued before all of its user's tokens were revoked.
+func (rl *revocationList) includes(claims *jwt.Claims) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	if _, ok := rl.revoked[claims.ID]; ok {
+		return true
+	}
+
+	if _, ok := rl.revoked[familyRevocationID(claims.Family)]; ok && claims.Family != "" {
+		return true
+	}
+
+	revokedAt, ok := rl.revoked[userRevocationID(claims.Subject)]
+	if !ok {
+		return false
+	}
+
+	// Tokens issued before iat_us was added only carry whole seconds.
+	if claims.IssuedAtMicro == 0 {
+		return claims.IssuedAt <= revokedAt.Unix()
+	}
+	return claims.IssuedAtMicro <= revokedAt.UnixMicro()
+}
+
+func (app *application) syncRevocations() error {
+	revoked, err := app.extended.Revocations.GetAllActive()
+	if err != nil {
+		return err
+	}
+
+	app.revocations.set(revoked)
+	return nil
+}
+
+// startRevocationSync reloads the revocation list every
+// revocationSyncInterval until ctx is cancelled.
+func (app *application) startRevocationSync(ctx context.Context) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(revocationSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := app.syncRevocations()
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+	}()
+}
+
+func (app *application) revokeJWT(claims *jwt.Claims) error {
+	revokedAt, err := app.extended.Revocations.Insert(claims.ID, time.Now(), time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return err
+	}
+
+	app.revocations.add(claims.ID, revokedAt)
+	return nil
+}
+
+// revokeAllJWTsForUser invalidates every access token issued to the user so
+// far. The entry only has to outlive the longest-lived access token.
+func (app *application) revokeAllJWTsForUser(userID int64) error {
+	id := userRevocationID(userID)
+
+	revokedAt, err := app.extended.Revocations.Insert(id, time.Now(), time.Now().Add(app.config.auth.accessTTL))
+	if err != nil {
+		return err
+	}
+
+	app.revocations.add(id, revokedAt)
+	return nil
+}
+
+// revokeJWTFamily invalidates the access tokens of a single session.
+func (app *application) revokeJWTFamily(family string) error {
+	id := familyRevocationID(family)
+
+	revokedAt, err := app.extended.Revocations.Insert(id, time.Now(), time.Now().Add(app.config.auth.accessTTL))
+	if err != nil {
+		return err
+	}
+
+	app.revocations.add(id, revokedAt)
+	return nil
+}
+
+func newJWTID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (app *application) newJWTAccessToken(user *models.User, family string) (*models.Token, error) {
+	id, err := newJWTID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTTL)
+
+	claims := jwt.Claims{
+		ID:            id,
+		Subject:       user.ID,
+		IssuedAt:      now.Unix(),
+		IssuedAtMicro: now.UnixMicro(),
+		ExpiresAt:     expiry.Unix(),
+		Family:        family,
+		Name:          user.Name,
+		Email:         user.Email,
+		Activated:     user.Activated,
+	}
+
+	signed, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     models.ScopeAuthentication,
+	}, nil
+}
+
+// userFromClaims rebuilds the request user from a verified JWT. The password
+// hash and version are not carried in the token, so handlers that need to
+// write the user back must reload it from the database first.
+func userFromClaims(claims *jwt.Claims) *models.User {
+	return &models.User{
+		ID:        claims.Subject,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Activated: claims.Activated,
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/validation"
+	"github.com/tomasen/realip"
+	"net/http"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.extended.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+		Parents     []string `json:"parents"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &extended.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+		Parents:     input.Parents,
+	}
+
+	if role.Parents == nil {
+		role.Parents = []string{}
+	}
+
+	v := validation.New()
+
+	if extended.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.Roles.Insert(role)
+	if err != nil {
+		app.roleErrorResponse(w, r, err)
+		return
+	}
+
+	app.auditRoles(r, "role.create", nil, role.Name)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/roles/%d", role.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateRoleHandler changes only the fields present in the request. The
+// permissions and parents given replace the role's current ones. As with
+// updateProfileHandler, an optional version guards against stale edits.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+		Parents     []string `json:"parents"`
+		Version     *int     `json:"version"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Version != nil && *input.Version != role.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+	if input.Parents != nil {
+		role.Parents = input.Parents
+	}
+
+	v := validation.New()
+
+	if extended.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.Roles.Update(role)
+	if err != nil {
+		app.roleErrorResponse(w, r, err)
+		return
+	}
+	app.permissionCache.invalidateAll()
+
+	app.auditRoles(r, "role.update", nil, role.Name)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.extended.Roles.Delete(role.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.permissionCache.invalidateAll()
+
+	app.auditRoles(r, "role.delete", nil, role.Name)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserRoles(w, r, user.ID)
+}
+
+func (app *application) assignUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	v.Check(len(input.Roles) >= 1, "roles", "must contain at least 1 role")
+	v.Check(validation.Unique(input.Roles), "roles", "must not contain duplicate values")
+	for i, name := range input.Roles {
+		extended.ValidateRoleName(v, fmt.Sprintf("roles[%d]", i), name)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.extended.Roles.Assign(user.ID, input.Roles...)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrUnknownRole):
+			v.AddError("roles", "must only contain existing roles")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.invalidateUser(user.ID)
+
+	app.auditRoles(r, "role.assign", &user.ID, input.Roles...)
+
+	app.writeUserRoles(w, r, user.ID)
+}
+
+func (app *application) unassignUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	name := httprouter.ParamsFromContext(r.Context()).ByName("role")
+
+	err := app.extended.Roles.Unassign(user.ID, name)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.invalidateUser(user.ID)
+
+	app.auditRoles(r, "role.unassign", &user.ID, name)
+
+	app.writeUserRoles(w, r, user.ID)
+}
+
+// readRoleParam returns the role named by the :id route parameter. It writes
+// the response itself whenever it returns false.
+func (app *application) readRoleParam(w http.ResponseWriter, r *http.Request) (*extended.Role, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	role, err := app.extended.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return role, true
+}
+
+// writeUserRoles responds with the roles assigned to the user and the
+// effective permissions they add up to.
+func (app *application) writeUserRoles(w http.ResponseWriter, r *http.Request, userID int64) {
+	roles, err := app.extended.Roles.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.extended.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) roleErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	v := validation.New()
+
+	switch {
+	case errors.Is(err, extended.ErrDuplicateRole):
+		v.AddError("name", "a role with this name already exists")
+	case errors.Is(err, extended.ErrUnknownPermission):
+		v.AddError("permissions", "must only contain existing permission codes")
+	case errors.Is(err, extended.ErrUnknownRole):
+		v.AddError("parents", "must only contain existing roles")
+	case errors.Is(err, extended.ErrRoleCycle):
+		v.AddError("parents", "must not make the role inherit from itself")
+	case errors.Is(err, extended.ErrEditConflict):
+		app.editConflictResponse(w, r)
+		return
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.failedValidationResponse(w, r, v.Errors)
+}
+
+func (app *application) auditRoles(r *http.Request, action string, userID *int64, roles ...string) {
+	app.audit(&extended.AuditEvent{
+		Action:  action,
+		Outcome: extended.AuditAllowed,
+		UserID:  userID,
+		IP:      realip.FromRequest(r),
+		Details: map[string]any{"roles": roles, "by": app.contextGetUser(r).ID},
+	})
+}
@@ -18,23 +18,87 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/vendors", app.listVendorsHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/vendors", app.requirePermission("vendors:write", app.createVendorHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/vendors/:id", app.showVendorHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/vendors/:id", app.requirePermission("vendors:write", app.updateVendorHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/vendors/:id", app.requirePermission("vendors:write", app.deleteVendorHandler))
 
+	router.HandlerFunc(http.MethodPost, "/v1/vendors/:id/contents", app.requirePermission("vendors:write", app.addVendorContentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/vendors/:id/contents/:content_id", app.requirePermission("vendors:write", app.removeVendorContentHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/upload/image", app.requirePermission("vendors:write", app.uploadImageHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/contents/:id", app.requireAuthenticatedUser(app.deleteContentHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/users/activate", app.requirePermission("vendors:read", app.showActivateUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/activate", app.showActivateUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users/activate", app.activateUserFormHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/users/logout", app.userLogoutHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showProfileHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireSessionUser(app.updateProfileHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireSessionUser(app.exportUserDataHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireSessionUser(app.deleteAccountHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireSessionUser(app.cancelAccountDeletionHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireSessionUser(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/revert", app.revertEmailChangeHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/logout", app.requireAuthenticatedUser(app.userLogoutHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/logout/all", app.requireSessionUser(app.userLogoutAllHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireSessionUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireSessionUser(app.deleteSessionHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/totp", app.requireSessionUser(app.enrolTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/totp/confirm", app.requireSessionUser(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa/totp", app.requireSessionUser(app.disableTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/recovery-codes", app.requireSessionUser(app.regenerateRecoveryCodesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireSessionUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireSessionUser(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireSessionUser(app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireSessionUser(app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireSessionUser(app.createOAuthClientHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireSessionUser(app.deleteOAuthClientHandler))
+
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.unlockUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission(permissionsAdmin, app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/permissions", app.requirePermission(permissionsAdmin, app.createPermissionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission(permissionsAdmin, app.listUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission(permissionsAdmin, app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission(permissionsAdmin, app.revokeUserPermissionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission(permissionsAdmin, app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission(permissionsAdmin, app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission(permissionsAdmin, app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission(permissionsAdmin, app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission(permissionsAdmin, app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission(permissionsAdmin, app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission(permissionsAdmin, app.assignUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission(permissionsAdmin, app.unassignUserRoleHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.verifyMFAHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/verify", app.verifyMagicLinkTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
+	router.HandlerFunc(http.MethodGet, "/v1/oidc", app.listOIDCProvidersHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oidc/:provider/authorize", app.oidcAuthorizeHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oidc/:provider/callback", app.oidcCallbackHandler)
+
+	router.HandlerFunc(http.MethodGet, "/oauth/authorize", app.requireSessionUser(app.showAuthorizeHandler))
+	router.HandlerFunc(http.MethodPost, "/oauth/authorize", app.requireSessionUser(app.authorizeHandler))
+	router.HandlerFunc(http.MethodPost, "/oauth/token", app.oauthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/oauth/introspect", app.oauthIntrospectHandler)
+	router.HandlerFunc(http.MethodPost, "/oauth/revoke", app.oauthRevokeHandler)
+
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
 }
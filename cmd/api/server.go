@@ -23,6 +23,16 @@ func (app *application) serve() error {
 
 	shutdownError := make(chan error)
 
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	app.startWorkers(workerCtx)
+	app.startTokenReaper(workerCtx)
+	app.startAccountPurger(workerCtx)
+	if app.revocations != nil {
+		app.startRevocationSync(workerCtx)
+	}
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -41,6 +51,7 @@ func (app *application) serve() error {
 
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
+		stopWorkers()
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/jwt"
+	"github.com/pistolricks/models/cmd/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionTouches throttles last-used updates so an active client causes at
+// most one write per session per minute rather than one per request.
+type sessionTouches struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (st *sessionTouches) due(key string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.last == nil || len(st.last) > 10_000 {
+		st.last = make(map[string]time.Time)
+	}
+
+	if time.Since(st.last[key]) < time.Minute {
+		return false
+	}
+	st.last[key] = time.Now()
+	return true
+}
+
+func (app *application) touchSession(r *http.Request, claims *jwt.Claims) {
+	var err error
+
+	switch {
+	case claims != nil:
+		if !app.sessions.due(claims.Family) {
+			return
+		}
+		err = app.extended.Sessions.Touch(claims.Family)
+	default:
+		token := app.contextGetToken(r)
+		if !app.sessions.due(token) {
+			return
+		}
+		err = app.extended.Sessions.TouchForToken(models.ScopeAuthentication, token)
+	}
+
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// currentFamily returns the token family of the session making the request.
+func (app *application) currentFamily(r *http.Request) (string, error) {
+	token := app.contextGetToken(r)
+
+	if app.jwtKeys != nil && jwt.LooksLikeJWT(token) {
+		claims, err := app.jwtKeys.Verify(token, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return claims.Family, nil
+	}
+
+	family, err := app.extended.Tokens.FamilyForPlaintext(models.ScopeAuthentication, token)
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		return "", err
+	}
+	return family, nil
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	family, err := app.currentFamily(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.extended.Sessions.GetAllForUser(user.ID, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	family, err := app.extended.Sessions.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	if app.jwtKeys != nil {
+		err = app.revokeJWTFamily(family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
 	"github.com/pistolricks/models/cmd/models"
 	"github.com/pistolricks/validation"
+	"github.com/tomasen/realip"
 	"net/http"
 	"time"
 )
@@ -29,10 +32,22 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	retryAfter, err := app.loginRetryAfter(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if retryAfter > 0 {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
+			app.recordLoginFailure(r, input.Email, nil)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -47,26 +62,119 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		app.recordLoginFailure(r, input.Email, user)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, models.ScopeAuthentication)
+	err = app.resetLoginFailures(input.Email)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "user": user}, nil)
+	app.beginLogin(w, r, user)
+}
+
+// beginLogin is called once a user's first factor has been checked. Users
+// with two-factor authentication get an MFA challenge token to present to
+// verifyMFAHandler; everyone else is logged straight in.
+func (app *application) beginLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	totp, err := app.extended.MFA.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if totp != nil && totp.Confirmed {
+		challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, extended.ScopeMFAChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.tokenIssued(user.ID, extended.ScopeMFAChallenge, "")
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": challenge}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin starts a new session for a fully authenticated user and
+// responds with its access and refresh tokens.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	family, err := extended.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, refreshToken, err := app.newAuthenticationTokens(user, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	session := &extended.Session{
+		Family:    family,
+		UserID:    user.ID,
+		IP:        realip.FromRequest(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	err = app.extended.Sessions.Insert(session)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken, "user": user}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+// newAuthenticationTokens issues an access token and a refresh token in the
+// given family. Access tokens are signed JWTs when running in jwt mode and
+// database tokens otherwise; refresh tokens always live in the database.
+func (app *application) newAuthenticationTokens(user *models.User, family string) (*models.Token, *models.Token, error) {
+	var token *models.Token
+	var err error
+
+	if app.jwtKeys != nil {
+		token, err = app.newJWTAccessToken(user, family)
+		if err == nil {
+			tokensIssued.Add(models.ScopeAuthentication, 1)
+		}
+	} else {
+		token, err = app.extended.Tokens.NewInFamily(user.ID, app.config.auth.accessTTL, models.ScopeAuthentication, family)
+		if err == nil {
+			app.tokenIssued(user.ID, models.ScopeAuthentication, "")
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := app.extended.Tokens.NewInFamily(user.ID, app.config.auth.refreshTTL, extended.ScopeRefresh, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	app.tokenIssued(user.ID, extended.ScopeRefresh, "")
+
+	return token, refreshToken, nil
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email string `json:"email"`
+		TokenPlaintext string `json:"refresh_token"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -77,55 +185,87 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 
 	v := validation.New()
 
-	if models.ValidateEmail(v, input.Email); !v.Valid() {
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetForToken(extended.ScopeRefresh, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
+			app.invalidAuthenticationTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	if !user.Activated {
-		v.AddError("email", "user account must be activated")
-		app.failedValidationResponse(w, r, v.Errors)
+	_, family, err := app.extended.Tokens.UseRefresh(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrTokenReused):
+			app.logger.Warn("refresh token reused, token family revoked", "ip", realip.FromRequest(r))
+			app.invalidateUser(user.ID)
+
+			// Access JWTs minted from the family are not in the tokens
+			// table, so they have to be revoked separately.
+			if app.jwtKeys != nil && family != "" {
+				err = app.revokeJWTFamily(family)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, models.ScopePasswordReset)
+	token, refreshToken, err := app.newAuthenticationTokens(user, family)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]any{
-			"passwordResetToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
+	err = app.extended.Sessions.Touch(family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
 
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+type tokenRequestPayload struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// createPasswordResetTokenHandler and createActivationTokenHandler answer the
+// same way whether or not the email belongs to an account, or whether that
+// account is in a state to receive the token. The lookup and the email happen
+// in a background job, so response times do not give it away either, and the
+// real outcome is only recorded in the audit log.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	app.enqueueTokenRequest(w, r, jobPasswordResetToken, "if an account exists for this email address, an email will be sent to it containing password reset instructions")
+}
+
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	app.enqueueTokenRequest(w, r, jobActivationToken, "if an inactive account exists for this email address, an email will be sent to it containing activation instructions")
+}
+
+func (app *application) enqueueTokenRequest(w http.ResponseWriter, r *http.Request, kind, message string) {
 	var input struct {
 		Email string `json:"email"`
 	}
@@ -143,45 +283,105 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	err = app.enqueueJob(kind, tokenRequestPayload{Email: input.Email, IP: realip.FromRequest(r)})
 	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	if user.Activated {
-		v.AddError("email", "user has already been activated")
-		app.failedValidationResponse(w, r, v.Errors)
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, models.ScopeActivation)
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
+func (app *application) passwordResetTokenJob(ctx context.Context, payload tokenRequestPayload) error {
+	event := &extended.AuditEvent{
+		Action:  "password_reset.request",
+		Outcome: extended.AuditDenied,
+		Email:   payload.Email,
+		IP:      payload.IP,
+	}
+
+	user, err := app.models.Users.GetByEmail(payload.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			event.Reason = "no account with this email address"
+			app.audit(event)
+			return nil
 		}
+		return err
+	}
+	event.UserID = &user.ID
 
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
+	if !user.Activated {
+		event.Reason = "account not activated"
+		app.audit(event)
+		return nil
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, models.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+	app.tokenIssued(user.ID, models.ScopePasswordReset, "")
+
+	data := map[string]any{
+		"passwordResetToken": token.Plaintext,
+	}
+
+	err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+	if err != nil {
+		return err
+	}
+
+	event.Outcome = extended.AuditAllowed
+	app.audit(event)
+	return nil
+}
+
+func (app *application) activationTokenJob(ctx context.Context, payload tokenRequestPayload) error {
+	event := &extended.AuditEvent{
+		Action:  "activation.request",
+		Outcome: extended.AuditDenied,
+		Email:   payload.Email,
+		IP:      payload.IP,
+	}
+
+	user, err := app.models.Users.GetByEmail(payload.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			event.Reason = "no account with this email address"
+			app.audit(event)
+			return nil
 		}
-	})
+		return err
+	}
+	event.UserID = &user.ID
+
+	if user.Activated {
+		event.Reason = "account already activated"
+		app.audit(event)
+		return nil
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, models.ScopeActivation)
+	if err != nil {
+		return err
+	}
+	app.tokenIssued(user.ID, models.ScopeActivation, "")
 
-	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+		"activationURL":   app.activationURL(token.Plaintext),
+	}
 
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		return err
 	}
+
+	event.Outcome = extended.AuditAllowed
+	app.audit(event)
+	return nil
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/jwt"
 	"github.com/pistolricks/models/cmd/models"
 	"github.com/pistolricks/validation"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -35,7 +39,16 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validation.New()
-	if models.ValidateUser(v, user); !v.Valid() {
+
+	models.ValidateUser(v, user)
+
+	err = app.passwords.Validate(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -62,17 +75,19 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.tokenIssued(user.ID, models.ScopeActivation, "")
 
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+		"activationURL":   app.activationURL(token.Plaintext),
+		"userID":          user.ID,
+	}
+
+	err = app.enqueueEmail(user.Email, "user_welcome.tmpl", data)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
@@ -80,22 +95,64 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+type activatePage struct {
+	State string
+	Token string
+}
+
+// showActivateUserHandler is where the link in activation emails leads. It
+// only shows a confirmation form: mail scanners routinely follow links, and a
+// GET that activated straight away would let them confirm an address on the
+// recipient's behalf.
 func (app *application) showActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	v := validation.New()
+
+	if models.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.renderPage(w, r, http.StatusBadRequest, "activate", activatePage{State: "invalid"})
+		return
+	}
+
+	app.renderPage(w, r, http.StatusOK, "activate", activatePage{State: "confirm", Token: token})
+}
+
+// activateUserFormHandler handles the form on the page rendered by
+// showActivateUserHandler.
+func (app *application) activateUserFormHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
 
-	err := app.readJSON(w, r, "")
+	err := r.ParseForm()
 	if err != nil {
-		app.badRequestResponse(w, r, err)
+		app.renderPage(w, r, http.StatusBadRequest, "activate", activatePage{State: "invalid"})
 		return
 	}
 
-	env := envelope{"message": "enter activation token"}
+	token := r.PostForm.Get("token")
 
-	err = app.writeJSON(w, http.StatusOK, env, nil)
+	v := validation.New()
+
+	if models.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.renderPage(w, r, http.StatusBadRequest, "activate", activatePage{State: "invalid"})
+		return
+	}
+
+	_, err = app.activateUser(token)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.renderPage(w, r, http.StatusBadRequest, "activate", activatePage{State: "invalid"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
+
+	app.renderPage(w, r, http.StatusOK, "activate", activatePage{State: "activated"})
 }
 
+// activateUserHandler is the JSON counterpart of activateUserFormHandler for
+// API clients.
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		TokenPlaintext string `json:"token"`
@@ -114,41 +171,55 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(models.ScopeActivation, input.TokenPlaintext)
+	user, err := app.activateUser(input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
 			v.AddError("token", "invalid or expired token activation token")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, models.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activateUser activates the owner of an activation token and revokes their
+// remaining activation tokens. An unknown or expired token returns
+// models.ErrRecordNotFound.
+func (app *application) activateUser(token string) (*models.User, error) {
+	user, err := app.models.Users.GetForToken(models.ScopeActivation, token)
+	if err != nil {
+		return nil, err
+	}
+
 	user.Activated = true
 
 	err = app.models.Users.Update(user)
 	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrEditConflict):
-			app.editConflictResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
+		return nil, err
 	}
+	app.invalidateUser(user.ID)
 
 	err = app.models.Tokens.DeleteAllForUser(models.ScopeActivation, user.ID)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	return user, nil
+}
+
+// activationURL is the link to showActivateUserHandler sent in activation
+// emails.
+func (app *application) activationURL(token string) string {
+	return strings.TrimRight(app.config.baseURL, "/") + "/v1/users/activate?token=" + url.QueryEscape(token)
 }
 
 func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
@@ -185,6 +256,17 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	err = app.passwords.Validate(v, input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -202,6 +284,8 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	app.invalidateUser(user.ID)
+
 	err = app.models.Tokens.DeleteAllForUser(models.ScopePasswordReset, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -217,10 +301,113 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 }
 
 func (app *application) userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	// API keys and OAuth tokens are not sessions and have nothing to log out
+	// of; without this they would be told they had been while nothing was
+	// revoked. Unlike requireSessionUser, unactivated users may still log out.
+	if app.contextGetScopes(r) != nil {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	token := app.contextGetToken(r)
+
+	if app.jwtKeys != nil && jwt.LooksLikeJWT(token) {
+		claims, err := app.jwtKeys.Verify(token, time.Now())
+		if err != nil {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		err = app.revokeJWT(claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.extended.Tokens.DeleteFamily(claims.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		err := app.extended.Tokens.DeleteForPlaintext(models.ScopeAuthentication, token)
+		if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// The rest of the session's tokens went with it, and the cache
+		// only knows them by user.
+		app.invalidateUser(user.ID)
+	}
+
+	sessions, err := app.countSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, models.AnonymousUser)
+
+	env := envelope{"message": "you have been logged out", "sessions": sessions}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) userLogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.countSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	r = app.contextSetUser(r, models.AnonymousUser)
 
-	err := app.writeJSON(w, http.StatusOK, envelope{"user": models.AnonymousUser}, nil)
+	env := envelope{"message": "you have been logged out of all sessions", "sessions_revoked": sessions}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// revokeAllSessions deletes every access and refresh token the user holds and,
+// in jwt mode, revokes the JWTs already handed out.
+func (app *application) revokeAllSessions(userID int64) error {
+	err := app.models.Tokens.DeleteAllForUser(models.ScopeAuthentication, userID)
+	if err != nil {
+		return err
+	}
+	app.invalidateUser(userID)
+
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeRefresh, userID)
+	if err != nil {
+		return err
+	}
+
+	if app.jwtKeys != nil {
+		return app.revokeAllJWTsForUser(userID)
+	}
+
+	return nil
+}
+
+// countSessions returns how many logins the user has open. In jwt mode access
+// tokens are not stored, so each live refresh token stands for a session.
+func (app *application) countSessions(userID int64) (int, error) {
+	if app.jwtKeys != nil {
+		return app.extended.Tokens.CountForUser(extended.ScopeRefresh, userID)
+	}
+	return app.extended.Tokens.CountForUser(models.ScopeAuthentication, userID)
+}
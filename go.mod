@@ -4,19 +4,21 @@ go 1.23.5
 
 require (
 	github.com/devedge/imagehash v0.0.0-20180324030135-7061aa3b4066
+	github.com/go-mail/mail/v2 v2.3.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
-	github.com/pistolricks/mailer v0.1.0
 	github.com/pistolricks/models v0.1.1
 	github.com/pistolricks/validation v0.1.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
+	golang.org/x/sync v0.10.0
 	golang.org/x/time v0.9.0
 )
 
 require (
 	github.com/disintegration/imaging v1.6.2 // indirect
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
 	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/image v0.23.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
+	gopkg.in/mail.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,260 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "gak_"
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// APIKey is a long-lived credential for machine clients. Only the prefix is
+// stored in the clear; the full key ("<prefix>.<secret>") is returned once
+// at creation in Plaintext.
+type APIKey struct {
+	ID          int64              `json:"id"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UserID      int64              `json:"-"`
+	Name        string             `json:"name"`
+	Prefix      string             `json:"prefix"`
+	Plaintext   string             `json:"key,omitempty"`
+	Hash        []byte             `json:"-"`
+	Permissions models.Permissions `json:"permissions"`
+	Expiry      *time.Time         `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time         `json:"last_used_at,omitempty"`
+}
+
+func randomBase32(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+func GenerateAPIKey(userID int64, name string, permissions []string, expiry *time.Time) (*APIKey, error) {
+	id, err := randomBase32(5)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomBase32(20)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Prefix:      apiKeyPrefix + id,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	key.Plaintext = key.Prefix + "." + secret
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+func ValidateAPIKey(v *validation.Validator, key *APIKey, granted models.Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validation.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(PermissionGranted(granted, code), "permissions", "must only contain permissions you hold")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array([]string(key.Permissions)), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetForPlaintext authenticates a presented key and returns it together with
+// its owner. The owner's password hash is not loaded.
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *models.User, error) {
+	prefix, _, found := strings.Cut(plaintext, ".")
+	if !found || !strings.HasPrefix(prefix, apiKeyPrefix) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	query := `
+		SELECT api_keys.id, api_keys.created_at, api_keys.user_id, api_keys.name, api_keys.prefix,
+			api_keys.hash, api_keys.permissions, api_keys.expiry, api_keys.last_used_at,
+			users.id, users.created_at, users.name, users.email, users.activated, users.version
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.prefix = $1`
+
+	var key APIKey
+	var user models.User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, prefix).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		(*pq.StringArray)(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrInvalidAPIKey
+		default:
+			return nil, nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+	if subtle.ConstantTimeCompare(hash[:], key.Hash) != 1 {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if key.Expiry != nil && !key.Expiry.After(time.Now()) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	return &key, &user, nil
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			(*pq.StringArray)(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+func (m APIKeyModel) Delete(id, userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser deletes every API key the user has created.
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,56 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+)
+
+// AuditEvent records a security-relevant decision together with the real
+// reason for it, which is often kept from the client. UserID is nil when the
+// subject did not resolve to an account.
+type AuditEvent struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Action    string         `json:"action"`
+	Outcome   string         `json:"outcome"`
+	Reason    string         `json:"reason,omitempty"`
+	UserID    *int64         `json:"user_id,omitempty"`
+	Email     string         `json:"email,omitempty"`
+	IP        string         `json:"ip,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+func (m AuditModel) Insert(event *AuditEvent) error {
+	details := event.Details
+	if details == nil {
+		details = map[string]any{}
+	}
+
+	js, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (action, outcome, reason, user_id, email, ip, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	args := []any{event.Action, event.Outcome, event.Reason, event.UserID, event.Email, event.IP, js}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
@@ -1,8 +1,12 @@
 package extended
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"github.com/lib/pq"
 	"github.com/pistolricks/validation"
+	"path"
 	"time"
 )
 
@@ -38,3 +42,277 @@ func (m ContentModel) DecodeWebP(content *Content) error {
 
 	return nil
 }
+
+// AttachToVendor adds a content to the vendor's gallery, or moves it if it is
+// already there. Marking it as the cover replaces any previous cover.
+func (m ContentModel) AttachToVendor(vendorID int64, contentID string, sortOrder int16, cover bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if cover {
+		_, err = tx.ExecContext(ctx, `UPDATE vendors_contents SET is_cover = false WHERE vendor_id = $1 AND is_cover`, vendorID)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO vendors_contents (vendor_id, content_id, sort_order, is_cover)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (vendor_id, content_id)
+		DO UPDATE SET sort_order = EXCLUDED.sort_order, is_cover = EXCLUDED.is_cover`
+
+	_, err = tx.ExecContext(ctx, query, vendorID, contentID, sortOrder, cover)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m ContentModel) DetachFromVendor(vendorID int64, contentID string) error {
+	query := `
+		DELETE FROM vendors_contents
+		WHERE vendor_id = $1 AND content_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, vendorID, contentID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// LoadGalleries fills in the cover and ordered gallery of each vendor with a
+// single query. A content's SortOrder reflects its position in the gallery.
+func (m ContentModel) LoadGalleries(vendors ...*Vendor) error {
+	if len(vendors) == 0 {
+		return nil
+	}
+
+	byID := make(map[int64]*Vendor, len(vendors))
+	ids := make([]int64, 0, len(vendors))
+	for _, vendor := range vendors {
+		vendor.Cover = nil
+		vendor.Contents = []*Content{}
+		byID[vendor.ID] = vendor
+		ids = append(ids, vendor.ID)
+	}
+
+	query := `
+		SELECT vendors_contents.vendor_id, vendors_contents.is_cover, vendors_contents.sort_order,
+			contents.id, contents.created_at, contents.name, contents.src, contents.type,
+			contents.size::bigint, contents.width, contents.height, contents.user_id
+		FROM contents
+		INNER JOIN vendors_contents ON vendors_contents.content_id = contents.id
+		WHERE vendors_contents.vendor_id = ANY($1)
+		ORDER BY vendors_contents.vendor_id, vendors_contents.sort_order, contents.created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var vendorID int64
+		var cover bool
+		var content Content
+
+		err := rows.Scan(
+			&vendorID,
+			&cover,
+			&content.SortOrder,
+			&content.ID,
+			&content.CreatedAt,
+			&content.Name,
+			&content.Src,
+			&content.Type,
+			&content.Size,
+			&content.Width,
+			&content.Height,
+			&content.UserID,
+		)
+		if err != nil {
+			return err
+		}
+
+		vendor := byID[vendorID]
+		if cover {
+			vendor.Cover = &content
+		}
+		vendor.Contents = append(vendor.Contents, &content)
+	}
+
+	return rows.Err()
+}
+
+// GetAllForUser lists the contents uploaded by owner, oldest first.
+func (m ContentModel) GetAllForUser(owner string) ([]*Content, error) {
+	query := `
+		SELECT id, created_at, name, src, type, size::bigint, width, height, sort_order, user_id
+		FROM contents
+		WHERE user_id = $1
+		ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contents := []*Content{}
+	for rows.Next() {
+		var content Content
+
+		err := rows.Scan(
+			&content.ID,
+			&content.CreatedAt,
+			&content.Name,
+			&content.Src,
+			&content.Type,
+			&content.Size,
+			&content.Width,
+			&content.Height,
+			&content.SortOrder,
+			&content.UserID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		contents = append(contents, &content)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return contents, nil
+}
+
+// FileOwners returns the owners of every content stored under the same file
+// as name. Uploads are kept in one flat directory by base name, so different
+// contents, even different users' contents, can share a file.
+func (m ContentModel) FileOwners(name string) ([]string, error) {
+	query := `
+		SELECT DISTINCT user_id
+		FROM contents
+		WHERE regexp_replace(name, '^.*/', '') = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, path.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := []string{}
+	for rows.Next() {
+		var owner string
+
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+
+		owners = append(owners, owner)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return owners, nil
+}
+
+func (m ContentModel) Get(id string) (*Content, error) {
+	query := `
+		SELECT id, created_at, name, src, type, size::bigint, width, height, sort_order, user_id
+		FROM contents
+		WHERE id = $1`
+
+	var content Content
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&content.ID,
+		&content.CreatedAt,
+		&content.Name,
+		&content.Src,
+		&content.Type,
+		&content.Size,
+		&content.Width,
+		&content.Height,
+		&content.SortOrder,
+		&content.UserID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &content, nil
+}
+
+// Delete removes the content. It is also detached from any vendor galleries,
+// and cleared from any user's avatar, by the foreign keys.
+func (m ContentModel) Delete(id string) error {
+	query := `
+		DELETE FROM contents
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// AccountDeletion is a user's request to delete their account. The account
+// stays usable, and the request can be cancelled, until PurgeAt.
+type AccountDeletion struct {
+	UserID      int64     `json:"-"`
+	RequestedAt time.Time `json:"requested_at"`
+	PurgeAt     time.Time `json:"purge_at"`
+}
+
+type DeletionModel struct {
+	DB *sql.DB
+}
+
+// Schedule records a deletion request for the user. Asking again while a
+// request is pending keeps the original schedule.
+func (m DeletionModel) Schedule(userID int64, purgeAt time.Time) (*AccountDeletion, error) {
+	query := `
+		INSERT INTO account_deletions (user_id, purge_at)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING requested_at, purge_at`
+
+	deletion := &AccountDeletion{UserID: userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, purgeAt).Scan(&deletion.RequestedAt, &deletion.PurgeAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return deletion, nil
+}
+
+func (m DeletionModel) Get(userID int64) (*AccountDeletion, error) {
+	query := `
+		SELECT user_id, requested_at, purge_at
+		FROM account_deletions
+		WHERE user_id = $1`
+
+	var deletion AccountDeletion
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&deletion.UserID, &deletion.RequestedAt, &deletion.PurgeAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &deletion, nil
+}
+
+func (m DeletionModel) Cancel(userID int64) error {
+	query := `
+		DELETE FROM account_deletions
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetDue returns up to limit users whose grace period has run out.
+func (m DeletionModel) GetDue(limit int) ([]int64, error) {
+	query := `
+		SELECT user_id
+		FROM account_deletions
+		WHERE purge_at <= $1
+		ORDER BY purge_at
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+
+		userIDs = append(userIDs, userID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+// Purge deletes the user along with the contents they own, as long as their
+// deletion is still due; a request cancelled in the meantime returns
+// ErrRecordNotFound. Everything else keyed on the user goes with it through
+// ON DELETE CASCADE; their audit events are kept but anonymised. It returns
+// the names of the deleted contents so their files can be removed from
+// storage once the rows are gone.
+func (m DeletionModel) Purge(userID int64, contentOwner string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var purgeAt time.Time
+
+	err = tx.QueryRowContext(ctx, `SELECT purge_at FROM account_deletions WHERE user_id = $1 FOR UPDATE`, userID).Scan(&purgeAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if purgeAt.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM contents WHERE user_id = $1 RETURNING name`, contentOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	_, err = tx.ExecContext(ctx, `UPDATE audit_events SET email = '', ip = '' WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
@@ -11,11 +11,41 @@ var (
 )
 
 type Extended struct {
-	Contents ContentModel
+	APIKeys       APIKeyModel
+	Audit         AuditModel
+	Contents      ContentModel
+	Deletions     DeletionModel
+	Identities    IdentityModel
+	Jobs          JobModel
+	LoginFailures LoginFailureModel
+	MFA           MFAModel
+	OAuth         OAuthModel
+	Permissions   PermissionModel
+	Revocations   RevocationModel
+	Roles         RoleModel
+	Sessions      SessionModel
+	Tokens        TokenModel
+	Users         UserModel
+	Vendors       VendorModel
 }
 
 func NewExtended(db *sql.DB) Extended {
 	return Extended{
-		Contents: ContentModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Contents:      ContentModel{DB: db},
+		Deletions:     DeletionModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		Jobs:          JobModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		MFA:           MFAModel{DB: db},
+		OAuth:         OAuthModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Revocations:   RevocationModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		Sessions:      SessionModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Users:         UserModel{DB: db},
+		Vendors:       VendorModel{DB: db},
 	}
 }
@@ -0,0 +1,126 @@
+package extended
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"github.com/pistolricks/models/cmd/models"
+	"time"
+)
+
+// OIDCState is the server-side half of an OpenID Connect login in progress,
+// found again by the state value the provider echoes back.
+type OIDCState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+func (m IdentityModel) InsertState(state *OIDCState) error {
+	hash := sha256.Sum256([]byte(state.State))
+
+	query := `
+		INSERT INTO oidc_states (hash, provider, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{hash[:], state.Provider, state.Nonce, state.CodeVerifier, state.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	// Abandoned logins never come back to claim their state, so clear out
+	// expired ones as new ones are added.
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry < NOW()`)
+	return err
+}
+
+// UseState deletes and returns the unexpired state for provider, so each
+// state can complete at most one login.
+func (m IdentityModel) UseState(provider, state string) (*OIDCState, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `
+		DELETE FROM oidc_states
+		WHERE hash = $1 AND provider = $2
+		RETURNING provider, nonce, code_verifier, expiry`
+
+	s := OIDCState{State: state}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider).Scan(&s.Provider, &s.Nonce, &s.CodeVerifier, &s.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if !s.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &s, nil
+}
+
+// GetUser returns the user linked to the provider's subject. The password
+// hash is not loaded.
+func (m IdentityModel) GetUser(provider, subject string) (*models.User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.activated, users.version
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2`
+
+	var user models.User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m IdentityModel) Link(userID int64, provider, subject, email string) error {
+	query := `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subject) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, provider, subject, userID, email)
+	return err
+}
@@ -0,0 +1,197 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+// ErrLeaseLost is returned by Complete and Fail when the job's lease expired
+// and it has since been reclaimed by another worker or dead-lettered.
+var ErrLeaseLost = errors.New("job lease lost")
+
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+func (m JobModel) Enqueue(kind string, payload any, maxAttempts int) (*Job, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		Kind:        kind,
+		Payload:     js,
+		Status:      JobPending,
+		MaxAttempts: maxAttempts,
+	}
+
+	query := `
+		INSERT INTO jobs (kind, payload, max_attempts)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, run_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, job.Kind, []byte(job.Payload), job.MaxAttempts).Scan(&job.ID, &job.CreatedAt, &job.RunAt)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Dequeue claims the next runnable job. Jobs left running by a worker that
+// died for longer than lease are treated as runnable again, unless they have
+// used up their attempts, in which case they are dead-lettered: a job that
+// kills or hangs its worker must not be retried forever. ErrRecordNotFound is
+// returned when the queue is empty.
+func (m JobModel) Dequeue(lease time.Duration) (*Job, error) {
+	expired := time.Now().Add(-lease)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE jobs
+		SET status = 'dead', payload = '{}', locked_at = NULL, updated_at = NOW(),
+			last_error = 'lease expired on the final attempt'
+		WHERE status = 'running' AND locked_at < $1 AND attempts >= max_attempts`
+
+	_, err := m.DB.ExecContext(ctx, query, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, locked_at = NOW(), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = 'pending' AND run_at <= NOW())
+			OR (status = 'running' AND locked_at < $1 AND attempts < max_attempts)
+			ORDER BY run_at, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+	var job Job
+	var payload []byte
+
+	err = m.DB.QueryRowContext(ctx, query, expired).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	job.Payload = payload
+	return &job, nil
+}
+
+// Complete marks the job done and clears its payload. Payloads can carry
+// plaintext tokens for emails, which must not outlive the job. ErrLeaseLost
+// is returned if this attempt no longer owns the job.
+func (m JobModel) Complete(job *Job) error {
+	query := `
+		UPDATE jobs
+		SET status = 'done', payload = '{}', locked_at = NULL, last_error = '', updated_at = NOW()
+		WHERE id = $1 AND status = 'running' AND attempts = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, job.ID, job.Attempts)
+	if err != nil {
+		return err
+	}
+
+	err = leaseHeld(result)
+	if err != nil {
+		return err
+	}
+
+	job.Status = JobDone
+	job.Payload = json.RawMessage(`{}`)
+	return nil
+}
+
+// Fail records a failed attempt. The job is scheduled to run again after
+// retryIn, or moved to the dead-letter state once it has used up all of its
+// attempts, when its payload is cleared as in Complete. ErrLeaseLost is
+// returned if this attempt no longer owns the job.
+func (m JobModel) Fail(job *Job, jobErr error, retryIn time.Duration) error {
+	job.Status = JobPending
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = JobDead
+	}
+	job.RunAt = time.Now().Add(retryIn)
+	job.LastError = jobErr.Error()
+
+	query := `
+		UPDATE jobs
+		SET status = $1, run_at = $2, last_error = $3, locked_at = NULL, updated_at = NOW(),
+			payload = CASE WHEN $1 = 'dead' THEN '{}' ELSE payload END
+		WHERE id = $4 AND status = 'running' AND attempts = $5`
+
+	args := []any{job.Status, job.RunAt, job.LastError, job.ID, job.Attempts}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	return leaseHeld(result)
+}
+
+func leaseHeld(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+type LoginFailure struct {
+	Key          string
+	Failures     int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+func LoginEmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func LoginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LoginPolicy decides how long a client must wait before its next login
+// attempt. The first FreeAttempts failures cost nothing; after that each
+// failure doubles the delay starting from BaseDelay, and reaching MaxFailures
+// locks the key for LockoutDuration.
+type LoginPolicy struct {
+	FreeAttempts    int
+	MaxFailures     int
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+}
+
+func (p LoginPolicy) RetryAfter(f *LoginFailure, now time.Time) time.Duration {
+	if f.LockedUntil != nil && f.LockedUntil.After(now) {
+		return f.LockedUntil.Sub(now)
+	}
+
+	if f.LockedUntil != nil || f.Failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < f.Failures && delay < p.LockoutDuration; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.LockoutDuration)
+
+	return max(f.LastFailedAt.Add(delay).Sub(now), 0)
+}
+
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+func (m LoginFailureModel) GetAll(keys ...string) ([]*LoginFailure, error) {
+	query := `
+		SELECT key, failures, last_failed_at, locked_until
+		FROM login_failures
+		WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []*LoginFailure
+	for rows.Next() {
+		var f LoginFailure
+
+		err := rows.Scan(&f.Key, &f.Failures, &f.LastFailedAt, &f.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, &f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+// Record counts a failed attempt against key. The count starts over once a
+// lockout has expired or after a day without failures. The returned bool is
+// true when this failure caused the key to become locked.
+func (m LoginFailureModel) Record(key string, maxFailures int, lockoutDuration time.Duration) (*LoginFailure, bool, error) {
+	query := `
+		WITH previous AS (
+			SELECT locked_until FROM login_failures WHERE key = $1
+		)
+		INSERT INTO login_failures AS lf (key, failures, last_failed_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN lf.locked_until < NOW() OR lf.last_failed_at < NOW() - INTERVAL '1 day' THEN 1
+				ELSE lf.failures + 1
+			END,
+			locked_until = CASE
+				WHEN lf.locked_until < NOW() OR lf.last_failed_at < NOW() - INTERVAL '1 day' THEN NULL
+				WHEN lf.locked_until IS NULL AND lf.failures + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second'
+				ELSE lf.locked_until
+			END,
+			last_failed_at = NOW()
+		RETURNING key, failures, last_failed_at, locked_until,
+			(locked_until IS NOT NULL AND (SELECT locked_until FROM previous) IS NULL)`
+
+	var f LoginFailure
+	var locked bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, maxFailures, lockoutDuration.Seconds()).Scan(
+		&f.Key,
+		&f.Failures,
+		&f.LastFailedAt,
+		&f.LockedUntil,
+		&locked,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &f, locked, nil
+}
+
+func (m LoginFailureModel) Reset(keys ...string) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// DeleteStale deletes up to limit records that no longer affect logins: those
+// whose lockout has expired and whose last failure is old enough that Record
+// would start the count over. Most belong to emails that were never
+// registered, and would otherwise accumulate forever.
+func (m LoginFailureModel) DeleteStale(limit int) (int64, error) {
+	query := `
+		DELETE FROM login_failures
+		WHERE key IN (
+			SELECT key
+			FROM login_failures
+			WHERE last_failed_at < NOW() - INTERVAL '1 day'
+			AND (locked_until IS NULL OR locked_until < NOW())
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
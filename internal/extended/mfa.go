@@ -0,0 +1,212 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeMFAChallenge = "mfa-challenge"
+)
+
+type TOTP struct {
+	UserID       int64
+	CreatedAt    time.Time
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// GenerateRecoveryCodes returns n one-time codes formatted as two groups of
+// five lower-case base32 characters, e.g. "k3x9q-2mfpa".
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 7)
+
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hash[:]
+}
+
+type MFAModel struct {
+	DB *sql.DB
+}
+
+func (m MFAModel) GetTOTP(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_used_step
+		FROM users_totp
+		WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.CreatedAt,
+		&totp.Secret,
+		&totp.Confirmed,
+		&totp.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// SetTOTP stores a new, unconfirmed secret for the user, replacing any
+// enrolment that has not been confirmed yet. A confirmed enrolment must be
+// removed with DeleteTOTP first, in which case ErrEditConflict is returned.
+func (m MFAModel) SetTOTP(userID int64, secret string) error {
+	query := `
+		INSERT INTO users_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE users_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// UseStep records that the code for step has been accepted, and reports false
+// if that step or a later one was already used, so codes cannot be replayed.
+func (m MFAModel) UseStep(userID int64, step int64, confirm bool) (bool, error) {
+	query := `
+		UPDATE users_totp
+		SET last_used_step = $2, confirmed = confirmed OR $3
+		WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step, confirm)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (m MFAModel) DeleteTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes discards the user's existing recovery codes and stores
+// hashes of the new ones.
+func (m MFAModel) ReplaceRecoveryCodes(userID int64, codes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, hashRecoveryCode(code), userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes a recovery code, reporting false if it does not
+// exist or has already been used.
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
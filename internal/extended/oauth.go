@@ -0,0 +1,467 @@
+package extended
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeOAuthCode    = "oauth-code"
+	ScopeOAuthAccess  = "oauth-access"
+	ScopeOAuthRefresh = "oauth-refresh"
+)
+
+// Access and refresh tokens carry a prefix so the authenticate middleware
+// and the revocation endpoint can tell them apart from first-party tokens
+// without a database round trip.
+const (
+	OAuthAccessTokenPrefix  = "oat_"
+	OAuthRefreshTokenPrefix = "ort_"
+	oauthClientIDPrefix     = "oac_"
+)
+
+var ErrInvalidClient = errors.New("invalid oauth client")
+
+// OAuthClient is a third-party application registered by a user. Public
+// clients (native and browser apps) have no secret and must authenticate
+// with PKCE alone.
+type OAuthClient struct {
+	ID           int64              `json:"id"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UserID       int64              `json:"-"`
+	ClientID     string             `json:"client_id"`
+	Secret       string             `json:"client_secret,omitempty"`
+	SecretHash   []byte             `json:"-"`
+	Name         string             `json:"name"`
+	RedirectURIs []string           `json:"redirect_uris"`
+	Scopes       models.Permissions `json:"scopes"`
+}
+
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != nil
+}
+
+// Authenticate reports whether secret matches the client's secret. Public
+// clients only authenticate when no secret is presented.
+func (c *OAuthClient) Authenticate(secret string) bool {
+	if !c.Confidential() {
+		return secret == ""
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func GenerateOAuthClient(userID int64, name string, redirectURIs, scopes []string, confidential bool) (*OAuthClient, error) {
+	id, err := randomBase32(10)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &OAuthClient{
+		UserID:       userID,
+		ClientID:     oauthClientIDPrefix + id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+	}
+
+	if confidential {
+		client.Secret, err = randomBase32(20)
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	return client, nil
+}
+
+func ValidateOAuthClient(v *validation.Validator, client *OAuthClient, granted models.Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 uri")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 uris")
+	v.Check(validation.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must be absolute https uris without a fragment (http is allowed for localhost)")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 permission")
+	v.Check(validation.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+
+	for _, code := range client.Scopes {
+		v.Check(PermissionGranted(granted, code), "scopes", "must only contain permissions you hold")
+	}
+}
+
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// ParseOAuthScope splits a space-delimited OAuth scope parameter into
+// permission codes.
+func ParseOAuthScope(scope string) models.Permissions {
+	return strings.Fields(scope)
+}
+
+// OAuthGrant is what an authorization code, access token or refresh token
+// stands for: a user's delegation of some permission codes to a client.
+type OAuthGrant struct {
+	Scope         string
+	UserID        int64
+	ClientID      string
+	Permissions   models.Permissions
+	Expiry        time.Time
+	Family        string
+	RedirectURI   string
+	CodeChallenge string
+}
+
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	query := `
+		INSERT INTO oauth_clients (user_id, client_id, secret_hash, name, redirect_uris, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{
+		client.UserID,
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array([]string(client.Scopes)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+func (m OAuthModel) GetClient(clientID string) (*OAuthClient, error) {
+	query := `
+		SELECT id, created_at, user_id, client_id, secret_hash, name, redirect_uris, scopes
+		FROM oauth_clients
+		WHERE client_id = $1`
+
+	var client OAuthClient
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, clientID).Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		(*pq.StringArray)(&client.Scopes),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrInvalidClient
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
+
+func (m OAuthModel) GetAllClientsForUser(userID int64) ([]*OAuthClient, error) {
+	query := `
+		SELECT id, created_at, user_id, client_id, secret_hash, name, redirect_uris, scopes
+		FROM oauth_clients
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.UserID,
+			&client.ClientID,
+			&client.SecretHash,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			(*pq.StringArray)(&client.Scopes),
+		)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// DeleteClient removes a client; its codes and tokens go with it through the
+// foreign key on tokens.client_id.
+func (m OAuthModel) DeleteClient(id, userID int64) error {
+	query := `
+		DELETE FROM oauth_clients
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// NewToken stores a code or token for grant and returns its plaintext. The
+// grant's Scope decides the plaintext's prefix.
+func (m OAuthModel) NewToken(grant *OAuthGrant) (string, error) {
+	plaintext, err := randomPlaintext()
+	if err != nil {
+		return "", err
+	}
+
+	switch grant.Scope {
+	case ScopeOAuthAccess:
+		plaintext = OAuthAccessTokenPrefix + plaintext
+	case ScopeOAuthRefresh:
+		plaintext = OAuthRefreshTokenPrefix + plaintext
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, family, client_id, permissions, redirect_uri, code_challenge)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''))`
+
+	args := []any{
+		hash[:],
+		grant.UserID,
+		grant.Expiry,
+		grant.Scope,
+		grant.Family,
+		grant.ClientID,
+		pq.Array([]string(grant.Permissions)),
+		grant.RedirectURI,
+		grant.CodeChallenge,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return plaintext, nil
+}
+
+// UseToken redeems a single-use authorization code or refresh token issued
+// to clientID. As with first-party refresh tokens, presenting one a second
+// time revokes everything in its family and returns ErrTokenReused.
+func (m OAuthModel) UseToken(scope, clientID, plaintext string) (*OAuthGrant, error) {
+	tokenHash := sha256.Sum256([]byte(plaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT scope, user_id, client_id, permissions, expiry, family,
+			COALESCE(redirect_uri, ''), COALESCE(code_challenge, ''), used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND client_id = $3
+		FOR UPDATE`
+
+	var grant OAuthGrant
+	var usedAt sql.NullTime
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], scope, clientID).Scan(
+		&grant.Scope,
+		&grant.UserID,
+		&grant.ClientID,
+		(*pq.StringArray)(&grant.Permissions),
+		&grant.Expiry,
+		&grant.Family,
+		&grant.RedirectURI,
+		&grant.CodeChallenge,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, grant.Family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+
+	if !grant.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+// GetToken looks up a live, unused access or refresh token and returns its
+// grant together with the user it acts for. The password hash is not loaded.
+func (m OAuthModel) GetToken(plaintext string) (*OAuthGrant, *models.User, error) {
+	tokenHash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT tokens.scope, tokens.user_id, tokens.client_id, tokens.permissions, tokens.expiry, tokens.family,
+			users.id, users.created_at, users.name, users.email, users.activated, users.version
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope IN ($2, $3)
+		AND tokens.expiry > $4
+		AND tokens.used_at IS NULL`
+
+	args := []any{tokenHash[:], ScopeOAuthAccess, ScopeOAuthRefresh, time.Now()}
+
+	var grant OAuthGrant
+	var user models.User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&grant.Scope,
+		&grant.UserID,
+		&grant.ClientID,
+		(*pq.StringArray)(&grant.Permissions),
+		&grant.Expiry,
+		&grant.Family,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &grant, &user, nil
+}
+
+// DeleteToken revokes a token issued to clientID. Revoking a refresh token
+// also revokes the access tokens issued alongside it; revoking an access
+// token leaves its refresh token alone. Unknown tokens are not an error.
+func (m OAuthModel) DeleteToken(clientID, plaintext string) error {
+	tokenHash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE client_id = $2
+		AND (hash = $1 OR family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $3 AND client_id = $2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], clientID, ScopeOAuthRefresh)
+	return err
+}
@@ -0,0 +1,250 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicatePermission = errors.New("duplicate permission")
+
+	PermissionCodeRX = regexp.MustCompile(`^(\*|(\*|[a-z][a-z0-9_-]*):(\*|[a-z][a-z0-9_-]*))$`)
+)
+
+// impliedActions lists, for each action, the actions holding it also grants.
+// The relation is followed transitively, so admin implies read as well.
+var impliedActions = map[string][]string{
+	"admin": {"write"},
+	"write": {"read"},
+}
+
+func ValidatePermissionCode(v *validation.Validator, key, code string) {
+	v.Check(code != "", key, "must be provided")
+	v.Check(len(code) <= 100, key, "must not be more than 100 bytes long")
+	v.Check(validation.Matches(code, PermissionCodeRX), key, "must look like resource:action, for example vendors:read, vendors:* or *")
+}
+
+// PermissionGranted reports whether any of the held codes grants code. Use it
+// instead of models.Permissions.Include, which only matches exactly. A held
+// code grants code when its resource is the same or "*" and its action is the
+// same, "*" or one implying it, so "vendors:write" grants "vendors:read" and
+// "*" grants everything.
+func PermissionGranted(held []string, code string) bool {
+	resource, action, _ := strings.Cut(code, ":")
+
+	for _, h := range held {
+		if h == "*" || h == code {
+			return true
+		}
+
+		hResource, hAction, _ := strings.Cut(h, ":")
+		if hResource != "*" && hResource != resource {
+			continue
+		}
+
+		if hAction == "*" || impliesAction(hAction, action) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func impliesAction(held, action string) bool {
+	if held == action {
+		return true
+	}
+
+	for _, implied := range impliedActions[held] {
+		if impliesAction(implied, action) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PermissionModel manages the permission codes themselves and who holds them.
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForUser returns the user's effective permissions: the codes granted to
+// them directly plus those of every role they hold, including inherited
+// roles. It replaces models.PermissionModel.GetAllForUser, which only knows
+// about direct grants.
+func (m PermissionModel) GetAllForUser(userID int64) (models.Permissions, error) {
+	query := `
+		WITH RECURSIVE user_roles AS (
+			SELECT role_id FROM users_roles WHERE user_id = $1
+			UNION
+			SELECT roles_parents.parent_id
+			FROM roles_parents
+			INNER JOIN user_roles ON roles_parents.role_id = user_roles.role_id
+		)
+		SELECT permissions.code
+		FROM permissions
+		WHERE permissions.id IN (
+			SELECT permission_id FROM users_permissions WHERE user_id = $1
+			UNION
+			SELECT permission_id FROM roles_permissions WHERE role_id IN (SELECT role_id FROM user_roles)
+		)
+		ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := models.Permissions{}
+	for rows.Next() {
+		var code string
+
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (m PermissionModel) GetAll() (models.Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := models.Permissions{}
+	for rows.Next() {
+		var code string
+
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (m PermissionModel) Insert(code string) error {
+	query := `
+		INSERT INTO permissions (code)
+		VALUES ($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, code)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicatePermission
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Grant gives the user every one of codes, ignoring those they already hold.
+// If any code does not exist nothing is granted and ErrRecordNotFound is
+// returned.
+func (m PermissionModel) Grant(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users_permissions (user_id, permission_id)
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	var found int
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM permissions WHERE code = ANY($1)`, pq.Array(codes)).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found != len(codes) {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// Revoke takes code away from the user. ErrRecordNotFound is returned if
+// they did not hold it.
+func (m PermissionModel) Revoke(userID int64, code string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+	"regexp"
+	"time"
+)
+
+var LocaleRX = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Profile is the view of a user that the user themselves can see and edit.
+// Email and password have their own flows and are read-only here. Version is
+// exposed so that clients can detect concurrent edits.
+type Profile struct {
+	ID              int64              `json:"id"`
+	CreatedAt       time.Time          `json:"created_at"`
+	Name            string             `json:"name"`
+	Email           string             `json:"email"`
+	Activated       bool               `json:"activated"`
+	DisplayName     string             `json:"display_name"`
+	Locale          string             `json:"locale"`
+	Timezone        string             `json:"timezone"`
+	AvatarContentID *string            `json:"avatar_content_id"`
+	Permissions     models.Permissions `json:"permissions"`
+	Version         int                `json:"version"`
+}
+
+func ValidateProfile(v *validation.Validator, profile *Profile) {
+	v.Check(profile.Name != "", "name", "must be provided")
+	v.Check(len(profile.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(len(profile.DisplayName) <= 100, "display_name", "must not be more than 100 bytes long")
+
+	if profile.Locale != "" {
+		v.Check(len(profile.Locale) <= 35, "locale", "must not be more than 35 bytes long")
+		v.Check(validation.Matches(profile.Locale, LocaleRX), "locale", "must be a valid language tag, such as en or en-GB")
+	}
+
+	if profile.Timezone != "" {
+		_, err := time.LoadLocation(profile.Timezone)
+		v.Check(err == nil && profile.Timezone != "Local", "timezone", "must be a valid IANA time zone, such as Europe/London")
+	}
+
+	if profile.AvatarContentID != nil {
+		v.Check(*profile.AvatarContentID != "", "avatar_content_id", "must not be empty")
+	}
+}
+
+// GetProfile loads the user's profile. Permissions are left for the caller
+// to fill in.
+func (m UserModel) GetProfile(id int64) (*Profile, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, activated, display_name, locale, timezone, avatar_content_id, version
+		FROM users
+		WHERE id = $1`
+
+	var profile Profile
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&profile.ID,
+		&profile.CreatedAt,
+		&profile.Name,
+		&profile.Email,
+		&profile.Activated,
+		&profile.DisplayName,
+		&profile.Locale,
+		&profile.Timezone,
+		&profile.AvatarContentID,
+		&profile.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &profile, nil
+}
+
+// UpdateProfile saves the editable fields of the profile, provided the user
+// has not changed since it was read. An avatar content ID that does not
+// exist returns ErrRecordNotFound.
+func (m UserModel) UpdateProfile(profile *Profile) error {
+	query := `
+		UPDATE users
+		SET name = $1, display_name = $2, locale = $3, timezone = $4, avatar_content_id = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version`
+
+	args := []any{
+		profile.Name,
+		profile.DisplayName,
+		profile.Locale,
+		profile.Timezone,
+		profile.AvatarContentID,
+		profile.ID,
+		profile.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&profile.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
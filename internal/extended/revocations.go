@@ -0,0 +1,90 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type RevocationModel struct {
+	DB *sql.DB
+}
+
+// Insert records a revocation made at revokedAt that only needs to be
+// remembered until expiry, after which the revoked tokens would be rejected
+// anyway. revokedAt comes from the caller's clock, the same one that stamps
+// new tokens, rather than the database's.
+func (m RevocationModel) Insert(id string, revokedAt, expiry time.Time) (time.Time, error) {
+	query := `
+		INSERT INTO jwt_revocations (id, revoked_at, expiry)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at, expiry = EXCLUDED.expiry
+		RETURNING revoked_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, revokedAt, expiry).Scan(&revokedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return revokedAt, nil
+}
+
+func (m RevocationModel) GetAllActive() (map[string]time.Time, error) {
+	query := `
+		SELECT id, revoked_at
+		FROM jwt_revocations
+		WHERE expiry > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var revokedAt time.Time
+
+		err := rows.Scan(&id, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		revocations[id] = revokedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// DeleteExpired deletes up to limit revocations that have outlived every
+// token they could apply to, and returns how many were deleted.
+func (m RevocationModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+		DELETE FROM jwt_revocations
+		WHERE id IN (
+			SELECT id
+			FROM jwt_revocations
+			WHERE expiry < NOW()
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
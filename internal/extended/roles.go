@@ -0,0 +1,430 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/pistolricks/validation"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrDuplicateRole     = errors.New("duplicate role")
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrRoleCycle         = errors.New("role inheritance cycle")
+
+	RoleNameRX = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
+
+// Role bundles permission codes so they can be given to users together. A
+// role also holds every permission of its parents, transitively.
+type Role struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	Parents     []string  `json:"parents"`
+	Version     int       `json:"version"`
+}
+
+func ValidateRoleName(v *validation.Validator, key, name string) {
+	v.Check(name != "", key, "must be provided")
+	v.Check(len(name) <= 50, key, "must not be more than 50 bytes long")
+	v.Check(validation.Matches(name, RoleNameRX), key, "must only contain lowercase letters, digits and dashes")
+}
+
+func ValidateRole(v *validation.Validator, role *Role) {
+	ValidateRoleName(v, "name", role.Name)
+
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validation.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+	for i, code := range role.Permissions {
+		ValidatePermissionCode(v, fmt.Sprintf("permissions[%d]", i), code)
+	}
+
+	v.Check(validation.Unique(role.Parents), "parents", "must not contain duplicate values")
+	for i, parent := range role.Parents {
+		ValidateRoleName(v, fmt.Sprintf("parents[%d]", i), parent)
+		v.Check(parent != role.Name, fmt.Sprintf("parents[%d]", i), "must not be the role itself")
+	}
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+const roleColumns = `
+	roles.id, roles.created_at, roles.name, roles.description, roles.version,
+	ARRAY(
+		SELECT permissions.code
+		FROM roles_permissions
+		INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE roles_permissions.role_id = roles.id
+		ORDER BY permissions.code
+	),
+	ARRAY(
+		SELECT parents.name
+		FROM roles_parents
+		INNER JOIN roles AS parents ON parents.id = roles_parents.parent_id
+		WHERE roles_parents.role_id = roles.id
+		ORDER BY parents.name
+	)`
+
+func scanRole(row interface{ Scan(...any) error }) (*Role, error) {
+	var role Role
+
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.Version,
+		(*pq.StringArray)(&role.Permissions),
+		(*pq.StringArray)(&role.Parents),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `SELECT ` + roleColumns + `
+		FROM roles
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + roleColumns + `
+		FROM roles
+		WHERE roles.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+// Insert creates the role with its permissions and parents. Unknown codes or
+// parent names return ErrUnknownPermission or ErrUnknownRole.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicateRole
+		}
+		return err
+	}
+
+	err = setRoleMembers(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update saves the role's description, permissions and parents, provided it
+// has not changed since it was read. Besides the errors Insert returns, a
+// parent that would make the role inherit from itself returns ErrRoleCycle.
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE roles
+		SET description = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version`
+
+	err = tx.QueryRowContext(ctx, query, role.Description, role.ID, role.Version).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = setRoleMembers(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func setRoleMembers(ctx context.Context, tx *sql.Tx, role *Role) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO roles_permissions (role_id, permission_id)
+		SELECT $1, id FROM permissions WHERE code = ANY($2)`, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted != int64(len(role.Permissions)) {
+		return ErrUnknownPermission
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM roles_parents WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return err
+	}
+
+	result, err = tx.ExecContext(ctx, `
+		INSERT INTO roles_parents (role_id, parent_id)
+		SELECT $1, id FROM roles WHERE name = ANY($2)`, role.ID, pq.Array(role.Parents))
+	if err != nil {
+		return err
+	}
+
+	inserted, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted != int64(len(role.Parents)) {
+		return ErrUnknownRole
+	}
+
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT parent_id FROM roles_parents WHERE role_id = $1
+			UNION
+			SELECT roles_parents.parent_id
+			FROM roles_parents
+			INNER JOIN ancestors ON roles_parents.role_id = ancestors.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE parent_id = $1)`
+
+	var cycle bool
+
+	err = tx.QueryRowContext(ctx, query, role.ID).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+
+	if cycle {
+		return ErrRoleCycle
+	}
+
+	return nil
+}
+
+// Delete removes the role. Users holding it, and roles inheriting from it,
+// lose its permissions.
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM roles
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllForUser returns the names of the roles assigned to the user directly,
+// not the ones they inherit.
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Assign gives the user every one of the named roles, ignoring those they
+// already hold. If any role does not exist nothing is assigned and
+// ErrUnknownRole is returned.
+func (m RoleModel) Assign(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM roles WHERE name = ANY($1)`, pq.Array(names)).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found != len(names) {
+		return ErrUnknownRole
+	}
+
+	query := `
+		INSERT INTO users_roles (user_id, role_id)
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Unassign takes the named role away from the user. ErrRecordNotFound is
+// returned if they did not hold it.
+func (m RoleModel) Unassign(userID int64, name string) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
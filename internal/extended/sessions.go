@@ -0,0 +1,187 @@
+package extended
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Session describes one login: the family of access and refresh tokens that
+// descend from it. The family is never exposed, only the numeric ID.
+type Session struct {
+	ID         int64     `json:"id"`
+	Family     string    `json:"-"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+func (m SessionModel) Insert(session *Session) error {
+	query := `
+		INSERT INTO sessions (family, user_id, ip, user_agent)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, last_used_at`
+
+	args := []any{session.Family, session.UserID, session.IP, session.UserAgent}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt)
+}
+
+// GetAllForUser lists the user's sessions that still hold a live token. The
+// session that currentFamily belongs to is marked as current.
+func (m SessionModel) GetAllForUser(userID int64, currentFamily string) ([]*Session, error) {
+	query := `
+		SELECT id, family, user_id, created_at, ip, user_agent, last_used_at
+		FROM sessions
+		WHERE user_id = $1
+		AND EXISTS (
+			SELECT 1 FROM tokens
+			WHERE tokens.family = sessions.family AND tokens.expiry > $2 AND tokens.used_at IS NULL
+		)
+		ORDER BY last_used_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.Family,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.IP,
+			&session.UserAgent,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		session.Current = session.Family == currentFamily
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (m SessionModel) Touch(family string) error {
+	query := `
+		UPDATE sessions
+		SET last_used_at = NOW()
+		WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// TouchForToken updates the last-used time of the session a database token
+// belongs to, without a separate lookup of the token's family.
+func (m SessionModel) TouchForToken(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE sessions
+		SET last_used_at = NOW()
+		FROM tokens
+		WHERE tokens.hash = $1 AND tokens.scope = $2 AND sessions.family = tokens.family`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	return err
+}
+
+// Delete removes one of the user's sessions along with every token in its
+// family, and returns the family so callers can revoke stateless tokens too.
+func (m SessionModel) Delete(id, userID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var family string
+
+	err = tx.QueryRowContext(ctx, `DELETE FROM sessions WHERE id = $1 AND user_id = $2 RETURNING family`, id, userID).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return family, nil
+}
+
+// DeleteDead deletes up to limit sessions that no longer hold a live token,
+// the ones GetAllForUser hides, and returns how many were deleted. Sessions
+// younger than an hour are left alone, as their first tokens may not have
+// been stored yet.
+func (m SessionModel) DeleteDead(limit int) (int64, error) {
+	query := `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT id
+			FROM sessions
+			WHERE created_at < NOW() - INTERVAL '1 hour'
+			AND NOT EXISTS (
+				SELECT 1 FROM tokens
+				WHERE tokens.family = sessions.family AND tokens.expiry > NOW() AND tokens.used_at IS NULL
+			)
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
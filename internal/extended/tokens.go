@@ -0,0 +1,398 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/pistolricks/models/cmd/models"
+	"time"
+)
+
+const (
+	ScopeRefresh     = "refresh"
+	ScopeEmailChange = "email-change"
+	ScopeEmailRevert = "email-revert"
+	ScopeMagicLink   = "magic-link"
+)
+
+var (
+	ErrTokenReused = errors.New("token reused")
+)
+
+func randomPlaintext() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// NewTokenFamily returns an identifier that ties together the access and
+// refresh tokens descended from a single login.
+func NewTokenFamily() (string, error) {
+	return randomPlaintext()
+}
+
+type TokenModel struct {
+	DB *sql.DB
+}
+
+func (m TokenModel) NewInFamily(userID int64, ttl time.Duration, scope, family string) (*models.Token, error) {
+	plaintext, err := randomPlaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token := &models.Token{
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, family)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, family}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// NewForEmail issues a token that carries an email address, used by the email
+// change flow: the new address for ScopeEmailChange and the previous one for
+// ScopeEmailRevert.
+func (m TokenModel) NewForEmail(userID int64, ttl time.Duration, scope, email string) (*models.Token, error) {
+	plaintext, err := randomPlaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token := &models.Token{
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, email)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetEmailForPlaintext returns the owner and email address of an unexpired
+// token issued by NewForEmail.
+func (m TokenModel) GetEmailForPlaintext(scope, tokenPlaintext string) (int64, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT user_id, email
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3 AND email IS NOT NULL`
+
+	var userID int64
+	var email string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(&userID, &email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, "", ErrRecordNotFound
+		default:
+			return 0, "", err
+		}
+	}
+
+	return userID, email, nil
+}
+
+// UseRefresh marks a refresh token as used and returns its owner and family.
+// Presenting a refresh token that has already been used revokes every token
+// in its family and returns ErrTokenReused, along with the owner and family
+// so that the caller can revoke anything issued outside the tokens table.
+func (m TokenModel) UseRefresh(tokenPlaintext string) (int64, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT user_id, family, expiry, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		FOR UPDATE`
+
+	var (
+		userID int64
+		family sql.NullString
+		expiry time.Time
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, "", ErrRecordNotFound
+		default:
+			return 0, "", err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family.String)
+		if err != nil {
+			return 0, "", err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return 0, "", err
+		}
+		return userID, family.String, ErrTokenReused
+	}
+
+	if !expiry.After(time.Now()) {
+		return 0, "", ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, "", err
+	}
+
+	return userID, family.String, nil
+}
+
+// Consume deletes an unexpired single-use token and returns its owner. The
+// delete is the check, so a token presented twice concurrently only works
+// once.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id`
+
+	var userID int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// DeleteForPlaintext deletes the token along with every other token in the
+// same family, so logging out also retires the matching refresh token.
+func (m TokenModel) DeleteForPlaintext(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE (hash = $1 AND scope = $2)
+		OR family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// FamilyForPlaintext returns the family a database token belongs to, or an empty
+// string if it predates token families.
+func (m TokenModel) FamilyForPlaintext(scope, tokenPlaintext string) (string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT family
+		FROM tokens
+		WHERE hash = $1 AND scope = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var family sql.NullString
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return family.String, nil
+}
+
+func (m TokenModel) DeleteFamily(family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// CountForUser returns the number of unexpired, unused tokens the user holds
+// in scope.
+func (m TokenModel) CountForUser(scope string, userID int64) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID, time.Now()).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Trim deletes the user's oldest outstanding tokens in scope so that at most
+// keep remain. OAuth tokens are counted per client; pass an empty clientID
+// for first-party tokens.
+func (m TokenModel) Trim(userID int64, scope, clientID string, keep int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE user_id = $1 AND scope = $2 AND client_id IS NOT DISTINCT FROM NULLIF($3, '')
+			AND used_at IS NULL
+			ORDER BY expiry DESC
+			OFFSET $4
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, scope, clientID, keep)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpired deletes up to limit expired tokens and returns how many were
+// deleted per scope. Rows locked by another transaction are skipped, so
+// running it in small batches never blocks logins for long.
+func (m TokenModel) DeleteExpired(limit int) (map[string]int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING scope`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := make(map[string]int64)
+	for rows.Next() {
+		var scope string
+
+		err := rows.Scan(&scope)
+		if err != nil {
+			return nil, err
+		}
+		deleted[scope]++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
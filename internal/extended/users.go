@@ -0,0 +1,51 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/pistolricks/models/cmd/models"
+	"time"
+)
+
+type UserModel struct {
+	DB *sql.DB
+}
+
+// Get looks a user up by ID. The password hash is private to the models
+// package and is not loaded, so the returned user must not be passed to
+// models.UserModel.Update; fetch it with GetByEmail for that instead.
+func (m UserModel) Get(id int64) (*models.User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, activated, version
+		FROM users
+		WHERE id = $1`
+
+	var user models.User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,263 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+	ErrNoSigningKey = errors.New("no signing key")
+)
+
+type Claims struct {
+	ID       string `json:"jti"`
+	Subject  int64  `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	// IssuedAtMicro is IssuedAt in microseconds, so that a token issued in
+	// the same second as a revocation can still be told apart from it.
+	IssuedAtMicro int64  `json:"iat_us,omitempty"`
+	ExpiresAt     int64  `json:"exp"`
+	Family        string `json:"fam,omitempty"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	Activated     bool   `json:"act"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type key struct {
+	id      string
+	alg     string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	secret  []byte
+}
+
+func (k *key) canSign() bool {
+	return k.private != nil || k.secret != nil
+}
+
+// KeySet holds every key that tokens may be verified against, and the one
+// new tokens are signed with. Rotating keys is a matter of adding a file to
+// the key directory, switching the signing kid, and removing the old file
+// once tokens signed with it have expired.
+type KeySet struct {
+	keys    map[string]*key
+	signing *key
+}
+
+// LoadKeyDir reads keys from dir. The file name without its extension is the
+// kid. "<kid>.pem" files hold a PKCS #8 Ed25519 private key (sign and verify)
+// or a PKIX public key (verify only); "<kid>.secret" files hold an HS256
+// shared secret. If signingKid is empty the last signing-capable kid in
+// lexical order is used.
+func LoadKeyDir(dir, signingKid string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: make(map[string]*key)}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		kid := strings.TrimSuffix(entry.Name(), ext)
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".pem":
+			k, err := parsePEM(kid, data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			ks.keys[kid] = k
+		case ".secret":
+			secret := []byte(strings.TrimSpace(string(data)))
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("%s: HS256 secret must be at least 32 bytes", entry.Name())
+			}
+			ks.keys[kid] = &key{id: kid, alg: AlgHS256, secret: secret}
+		}
+	}
+
+	if signingKid == "" {
+		kids := make([]string, 0, len(ks.keys))
+		for kid, k := range ks.keys {
+			if k.canSign() {
+				kids = append(kids, kid)
+			}
+		}
+		if len(kids) == 0 {
+			return nil, ErrNoSigningKey
+		}
+		slices.Sort(kids)
+		signingKid = kids[len(kids)-1]
+	}
+
+	k, ok := ks.keys[signingKid]
+	if !ok || !k.canSign() {
+		return nil, fmt.Errorf("%w: %q", ErrNoSigningKey, signingKid)
+	}
+	ks.signing = k
+
+	return ks, nil
+}
+
+func parsePEM(kid string, data []byte) (*key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not Ed25519")
+		}
+		return &key{id: kid, alg: AlgEdDSA, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not Ed25519")
+		}
+		return &key{id: kid, alg: AlgEdDSA, public: public}, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	k := ks.signing
+
+	h, err := json.Marshal(header{Alg: k.alg, Typ: "JWT", Kid: k.id})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var signature []byte
+	switch k.alg {
+	case AlgEdDSA:
+		signature = ed25519.Sign(k.private, []byte(signingInput))
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature against the key named by the token's kid and
+// returns the claims if the token has not expired.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var hdr header
+	err = json.Unmarshal(h, &hdr)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	k, ok := ks.keys[hdr.Kid]
+	if !ok || hdr.Alg != k.alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	switch k.alg {
+	case AlgEdDSA:
+		if !ed25519.Verify(k.public, signingInput, signature) {
+			return nil, ErrInvalidToken
+		}
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signingInput)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = json.Unmarshal(c, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return &claims, nil
+}
+
+// LooksLikeJWT reports whether token has the three dot-separated segments of
+// a compact JWS, as opposed to an opaque database token.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
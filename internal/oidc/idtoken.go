@@ -0,0 +1,303 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the provider's clock may disagree with ours.
+const clockSkew = time.Minute
+
+// keyRefetchInterval stops tokens with made-up kids from hammering the
+// provider's JWKS endpoint.
+const keyRefetchInterval = time.Minute
+
+// IDToken holds the claims this API uses from a verified ID token.
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	ExpiresAt     time.Time
+}
+
+// audience accepts both forms the aud claim may take.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// flexibleBool accepts the "true"/"false" strings some providers send for
+// email_verified.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+type claims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      audience     `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	ExpiresAt     int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	public crypto.PublicKey
+}
+
+func (k *jwk) parse() bool {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return false
+		}
+		k.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return false
+		}
+		x, y := decode(k.X), decode(k.Y)
+		if x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return false
+		}
+		k.public = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return false
+		}
+		k.public = ed25519.PublicKey(x)
+	default:
+		return false
+	}
+
+	return k.Use == "" || k.Use == "sig"
+}
+
+// key returns the signing key named kid, refetching the JWKS if it is not
+// cached. Tokens without a kid are accepted when the set holds one key.
+func (p *Provider) key(ctx context.Context, kid string) (*jwk, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lookup := func() *jwk {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+
+	if time.Since(p.keysFetchedAt) < keyRefetchInterval {
+		return nil, ErrInvalidIDToken
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+
+	err = p.getJSON(ctx, d.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]*jwk)
+	p.keysFetchedAt = time.Now()
+
+	for _, k := range set.Keys {
+		if k.parse() {
+			p.keys[k.Kid] = k
+		}
+	}
+
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+
+	return nil, ErrInvalidIDToken
+}
+
+// Verify checks an ID token's signature against the provider's JWKS and
+// validates its issuer, audience, lifetime and nonce as required by OpenID
+// Connect Core section 3.1.3.7.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string, now time.Time) (*IDToken, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var hdr header
+	err = json.Unmarshal(h, &hdr)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	k, err := p.key(ctx, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	if !verifySignature(k.public, hdr.Alg, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidIDToken
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var cl claims
+	err = json.Unmarshal(c, &cl)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	switch {
+	case strings.TrimSuffix(cl.Issuer, "/") != p.Issuer:
+		return nil, ErrInvalidIDToken
+	case !slices.Contains(cl.Audience, p.ClientID):
+		return nil, ErrInvalidIDToken
+	case len(cl.Audience) > 1 && cl.AuthorizedBy != p.ClientID:
+		return nil, ErrInvalidIDToken
+	case now.Add(-clockSkew).Unix() >= cl.ExpiresAt:
+		return nil, ErrInvalidIDToken
+	case cl.IssuedAt > now.Add(clockSkew).Unix():
+		return nil, ErrInvalidIDToken
+	case cl.Nonce != nonce || cl.Subject == "":
+		return nil, ErrInvalidIDToken
+	}
+
+	return &IDToken{
+		Issuer:        cl.Issuer,
+		Subject:       cl.Subject,
+		Email:         cl.Email,
+		EmailVerified: bool(cl.EmailVerified),
+		Name:          cl.Name,
+		ExpiresAt:     time.Unix(cl.ExpiresAt, 0),
+	}, nil
+}
+
+// verifySignature checks a JWS signature. The algorithm must match the key
+// type, which rules out "none" and HMAC confusion with a public key.
+func verifySignature(public crypto.PublicKey, alg string, signingInput, signature []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "PS512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return false
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signingInput)
+		digest = h.Sum(nil)
+	}
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || size != hash.Size() || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signingInput, signature)
+	}
+
+	return false
+}
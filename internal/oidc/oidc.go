@@ -0,0 +1,252 @@
+// Package oidc is a minimal OpenID Connect relying party: discovery, the
+// authorization code flow with PKCE, and ID token verification against the
+// provider's published JWKS.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+	ErrExchange       = errors.New("code exchange failed")
+)
+
+// Config describes one provider as set on the command line.
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       []string
+}
+
+// ParseConfig parses a space separated list of key=value pairs, for example
+// "name=google issuer=https://accounts.google.com client-id=... client-secret=...
+// redirect-uri=https://app.example.com/login/callback". Scopes default to
+// "openid email profile".
+func ParseConfig(s string) (Config, error) {
+	cfg := Config{Scopes: []string{"openid", "email", "profile"}}
+
+	for _, field := range strings.Fields(s) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return cfg, fmt.Errorf("oidc provider: %q is not key=value", field)
+		}
+
+		switch key {
+		case "name":
+			cfg.Name = value
+		case "issuer":
+			cfg.Issuer = strings.TrimSuffix(value, "/")
+		case "client-id":
+			cfg.ClientID = value
+		case "client-secret":
+			cfg.ClientSecret = value
+		case "redirect-uri":
+			cfg.RedirectURI = value
+		case "scopes":
+			cfg.Scopes = strings.Split(value, ",")
+		default:
+			return cfg, fmt.Errorf("oidc provider: unknown key %q", key)
+		}
+	}
+
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURI == "" {
+		return cfg, errors.New("oidc provider: name, issuer, client-id and redirect-uri are required")
+	}
+
+	if !slices.Contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+
+	return cfg, nil
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is a configured identity provider. Its discovery document is
+// fetched on first use and its signing keys are refetched whenever a token
+// names a key that is not cached, so provider key rotation needs no restart.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *discovery
+	keys          map[string]*jwk
+	keysFetchedAt time.Time
+}
+
+func NewProvider(cfg Config) *Provider {
+	return &Provider{
+		Config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d discovery
+
+	err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, uri string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", uri, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
+
+// AuthCodeURL returns the URL to send the user to. The verifier is kept by
+// the caller and handed back to Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURI)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the raw ID token. The caller must still Verify it.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURI},
+		"code_verifier": {verifier},
+	}
+
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrExchange, res.Status)
+	}
+
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("%w: %s %s %s", ErrExchange, res.Status, body.Error, body.ErrorDescription)
+	}
+
+	return body.IDToken, nil
+}
+
+// RandomString returns a URL-safe random string suitable for state, nonce
+// and PKCE verifier values.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE code challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,346 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "test-client"
+	testClientSecret = "test-secret"
+	testCode         = "test-code"
+	testVerifier     = "test-verifier"
+	testNonce        = "test-nonce"
+)
+
+// testIdP is a stand-in identity provider serving discovery, a JWKS and a
+// token endpoint that answers testCode with whatever idToken is set to.
+type testIdP struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	idToken     string
+	jwksFetches int
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	idp := &testIdP{keys: make(map[string]*rsa.PrivateKey)}
+	idp.addKey(t, "key-1")
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+
+		idp.jwksFetches++
+
+		keys := []map[string]string{}
+		for kid, key := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+
+		switch {
+		case !ok || id != testClientID || secret != testClientSecret:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case r.PostFormValue("grant_type") != "authorization_code",
+			r.PostFormValue("code") != testCode,
+			r.PostFormValue("code_verifier") != testVerifier:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken, "token_type": "Bearer"})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *testIdP) addKey(t *testing.T, kid string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.mu.Lock()
+	idp.keys[kid] = key
+	idp.mu.Unlock()
+}
+
+func (idp *testIdP) fetches() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	return idp.jwksFetches
+}
+
+func (idp *testIdP) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURI:  "http://localhost/callback",
+		Scopes:       []string{"openid", "email"},
+	})
+}
+
+// claims returns a valid set of ID token claims for the provider.
+func (idp *testIdP) claims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":            idp.URL,
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// sign returns an RS256 ID token signed with the IdP's key kid.
+func (idp *testIdP) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+
+	idp.mu.Lock()
+	key := idp.keys[kid]
+	idp.mu.Unlock()
+
+	input := encodeSegment(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + encodeSegment(t, claims)
+
+	digest := sha256.Sum256([]byte(input))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestExchangeAndVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	ctx := context.Background()
+	now := time.Now()
+
+	idToken := idp.sign(t, "key-1", idp.claims(now))
+	idp.mu.Lock()
+	idp.idToken = idToken
+	idp.mu.Unlock()
+
+	raw, err := p.Exchange(ctx, testCode, testVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	token, err := p.Verify(ctx, raw, testNonce, now)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if token.Subject != "subject-1" || token.Email != "alice@example.com" || !token.EmailVerified || token.Name != "Alice" {
+		t.Errorf("unexpected token: %+v", token)
+	}
+
+	_, err = p.Exchange(ctx, "wrong-code", testVerifier)
+	if !errors.Is(err, ErrExchange) {
+		t.Errorf("Exchange with a wrong code: got %v, want ErrExchange", err)
+	}
+
+	_, err = p.Exchange(ctx, testCode, "wrong-verifier")
+	if !errors.Is(err, ErrExchange) {
+		t.Errorf("Exchange with a wrong verifier: got %v, want ErrExchange", err)
+	}
+}
+
+func TestVerifyRejectsInvalidClaims(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(c map[string]any)
+		nonce  string
+	}{
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "another-client" }},
+		{name: "several audiences without azp", modify: func(c map[string]any) { c["aud"] = []string{testClientID, "another-client"} }},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://attacker.example.com" }},
+		{name: "wrong nonce", nonce: "another-nonce"},
+		{name: "missing nonce", modify: func(c map[string]any) { delete(c, "nonce") }},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = now.Add(-2 * clockSkew).Unix() }},
+		{name: "issued in the future", modify: func(c map[string]any) { c["iat"] = now.Add(2 * clockSkew).Unix() }},
+		{name: "no subject", modify: func(c map[string]any) { delete(c, "sub") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims(now)
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+
+			nonce := testNonce
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+
+			_, err := p.Verify(context.Background(), idp.sign(t, "key-1", claims), nonce, now)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("got %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsAlgorithmConfusion(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	now := time.Now()
+
+	payload := encodeSegment(t, idp.claims(now))
+
+	t.Run("none", func(t *testing.T) {
+		raw := encodeSegment(t, map[string]string{"alg": "none", "kid": "key-1"}) + "." + payload + "."
+
+		_, err := p.Verify(context.Background(), raw, testNonce, now)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got %v, want ErrInvalidIDToken", err)
+		}
+	})
+
+	t.Run("HS256 keyed with the public key", func(t *testing.T) {
+		idp.mu.Lock()
+		public := idp.keys["key-1"].PublicKey
+		idp.mu.Unlock()
+
+		input := encodeSegment(t, map[string]string{"alg": "HS256", "kid": "key-1"}) + "." + payload
+
+		// Whatever form of the public key an attacker feeds to HMAC, the
+		// algorithm must be refused before any signature is compared.
+		for _, secret := range [][]byte{public.N.Bytes(), []byte(base64.RawURLEncoding.EncodeToString(public.N.Bytes()))} {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(input))
+			raw := input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+			_, err := p.Verify(context.Background(), raw, testNonce, now)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("got %v, want ErrInvalidIDToken", err)
+			}
+		}
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		raw := idp.sign(t, "key-1", idp.claims(now))
+
+		claims := idp.claims(now)
+		claims["sub"] = "subject-2"
+
+		parts := strings.Split(raw, ".")
+		forged := parts[0] + "." + encodeSegment(t, claims) + "." + parts[2]
+
+		_, err := p.Verify(context.Background(), forged, testNonce, now)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got %v, want ErrInvalidIDToken", err)
+		}
+	})
+}
+
+func TestVerifyRefetchesKeysForUnknownKid(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	ctx := context.Background()
+	now := time.Now()
+
+	_, err := p.Verify(ctx, idp.sign(t, "key-1", idp.claims(now)), testNonce, now)
+	if err != nil {
+		t.Fatalf("Verify with the initial key: %v", err)
+	}
+
+	// The provider rotates its keys. Within keyRefetchInterval of the last
+	// fetch an unknown kid is refused without asking the provider again.
+	idp.addKey(t, "key-2")
+	rotated := idp.sign(t, "key-2", idp.claims(now))
+
+	_, err = p.Verify(ctx, rotated, testNonce, now)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Verify straight after the last fetch: got %v, want ErrInvalidIDToken", err)
+	}
+	if n := idp.fetches(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+
+	p.mu.Lock()
+	p.keysFetchedAt = time.Now().Add(-keyRefetchInterval)
+	p.mu.Unlock()
+
+	_, err = p.Verify(ctx, rotated, testNonce, now)
+	if err != nil {
+		t.Fatalf("Verify with the rotated key: %v", err)
+	}
+	if n := idp.fetches(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
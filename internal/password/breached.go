@@ -0,0 +1,143 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const hashLen = sha1.Size * 2
+
+// BreachedList looks passwords up in a local copy of a breached-password
+// corpus such as Have I Been Pwned's. The file holds one SHA-1 hash per line
+// in hex, optionally followed by ":count", sorted by hash: the format the
+// k-anonymity range API serves once each suffix is joined back to its
+// five-character prefix. The file is searched in place, so corpora far larger
+// than memory work fine.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens path and checks that it looks like a hash list.
+func OpenBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &BreachedList{file: file, size: info.Size()}
+
+	first, ok, err := l.hashFrom(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("breached password list %s: no line holds a hash", path)
+	}
+
+	_, err = hex.DecodeString(string(first))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("breached password list %s: lines must start with a hex SHA-1 hash", path)
+	}
+
+	return l, nil
+}
+
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// Contains reports whether password's SHA-1 hash is in the list.
+func (l *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := bytes.ToUpper([]byte(hex.EncodeToString(sum[:])))
+
+	// Binary search for the first line, by byte offset, whose hash is not
+	// less than the target.
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		hash, ok, err := l.hashFrom(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok || bytes.Compare(hash, target) >= 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	hash, ok, err := l.hashFrom(lo)
+	if err != nil {
+		return false, err
+	}
+
+	return ok && bytes.Equal(hash, target), nil
+}
+
+// hashFrom returns the upper-cased hash of the first line starting at or
+// after offset, or false if there is none. Lines too short to hold a hash
+// are skipped, so that they cannot stop the search early.
+func (l *BreachedList) hashFrom(offset int64) ([]byte, bool, error) {
+	start := max(offset-1, 0)
+
+	buf, err := l.readAt(start)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return nil, false, nil
+		}
+		start += int64(i + 1)
+		buf = buf[i+1:]
+	}
+
+	for {
+		if len(buf) >= hashLen && bytes.IndexByte(buf[:hashLen], '\n') < 0 {
+			return bytes.ToUpper(buf[:hashLen]), true, nil
+		}
+
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return nil, false, nil
+		}
+		start += int64(i + 1)
+
+		buf, err = l.readAt(start)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+func (l *BreachedList) readAt(offset int64) ([]byte, error) {
+	buf := make([]byte, 256)
+
+	n, err := l.file.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
@@ -0,0 +1,199 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeList writes contents to a file in a temporary directory and opens it.
+func writeList(t *testing.T, contents string) *BreachedList {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := OpenBreachedList(path)
+	if err != nil {
+		t.Fatalf("OpenBreachedList: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// sortedHashes returns the hashes of n passwords, in sorted order.
+func sortedHashes(n int) []string {
+	hashes := make([]string, n)
+	for i := range hashes {
+		hashes[i] = sha1Hex(fmt.Sprintf("breached-%d", i))
+	}
+	slices.Sort(hashes)
+	return hashes
+}
+
+func TestBreachedListContains(t *testing.T) {
+	var b strings.Builder
+	for i, hash := range sortedHashes(200) {
+		// Counts of varying width, so lines differ in length.
+		fmt.Fprintf(&b, "%s:%d\n", hash, i*i*37)
+	}
+
+	l := writeList(t, b.String())
+
+	for i := range 200 {
+		password := fmt.Sprintf("breached-%d", i)
+
+		found, err := l.Contains(password)
+		if err != nil {
+			t.Fatalf("Contains(%q): %v", password, err)
+		}
+		if !found {
+			t.Errorf("Contains(%q) = false, want true", password)
+		}
+	}
+
+	for _, password := range []string{"", "breached-200", "correct horse battery staple"} {
+		found, err := l.Contains(password)
+		if err != nil {
+			t.Fatalf("Contains(%q): %v", password, err)
+		}
+		if found {
+			t.Errorf("Contains(%q) = true, want false", password)
+		}
+	}
+}
+
+func TestBreachedListBoundaries(t *testing.T) {
+	hashes := sortedHashes(3)
+
+	// Passwords whose hashes sort first and last among sortedHashes(3).
+	var first, last string
+	for i := range 3 {
+		password := fmt.Sprintf("breached-%d", i)
+		switch sha1Hex(password) {
+		case hashes[0]:
+			first = password
+		case hashes[2]:
+			last = password
+		}
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+		present  []string
+		absent   []string
+	}{
+		{
+			name:     "single line",
+			contents: hashes[0] + ":1\n",
+			present:  []string{first},
+			absent:   []string{last},
+		},
+		{
+			name:     "first and last line",
+			contents: strings.Join(hashes, ":5\n") + ":5\n",
+			present:  []string{first, last},
+		},
+		{
+			name:     "no trailing newline",
+			contents: strings.Join(hashes, "\n"),
+			present:  []string{first, last},
+		},
+		{
+			name:     "lower-case hashes",
+			contents: strings.ToLower(strings.Join(hashes, "\n")) + "\n",
+			present:  []string{first, last},
+		},
+		{
+			name:     "CRLF line endings",
+			contents: strings.Join(hashes, ":2\r\n") + ":2\r\n",
+			present:  []string{first, last},
+		},
+		{
+			name:     "truncated last line",
+			contents: hashes[0] + "\n" + hashes[1] + "\n" + hashes[2][:20],
+			present:  []string{first},
+			absent:   []string{last},
+		},
+		{
+			name:     "short line in the middle",
+			contents: hashes[0] + "\nABC\n" + hashes[2] + "\n",
+			present:  []string{first, last},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := writeList(t, tt.contents)
+
+			for _, password := range tt.present {
+				found, err := l.Contains(password)
+				if err != nil {
+					t.Fatalf("Contains(%q): %v", password, err)
+				}
+				if !found {
+					t.Errorf("Contains(%q) = false, want true", password)
+				}
+			}
+
+			for _, password := range tt.absent {
+				found, err := l.Contains(password)
+				if err != nil {
+					t.Fatalf("Contains(%q): %v", password, err)
+				}
+				if found {
+					t.Errorf("Contains(%q) = true, want false", password)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenBreachedListRejectsBadFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "empty", contents: ""},
+		{name: "shorter than a hash", contents: "5BAA61E4\n"},
+		{name: "not hex", contents: strings.Repeat("Z", hashLen) + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "breached.txt")
+
+			err := os.WriteFile(path, []byte(tt.contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := OpenBreachedList(path)
+			if err == nil {
+				l.Close()
+				t.Error("got nil error, want an error")
+			}
+		})
+	}
+
+	_, err := OpenBreachedList(filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("missing file: got nil error, want an error")
+	}
+}
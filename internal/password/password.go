@@ -0,0 +1,104 @@
+// Package password implements the password policy applied when a user sets a
+// password, on top of the length rules in models.ValidatePasswordPlaintext.
+package password
+
+import (
+	"github.com/pistolricks/validation"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Policy rejects guessable passwords. A nil Breached list skips the breach
+// check.
+type Policy struct {
+	MinEntropy float64
+	Breached   *BreachedList
+}
+
+// Validate records any policy violations for password on v under the
+// "password" key. name and email are the account's, and must not appear in
+// the password. Only a failure to read the breached list is returned as an
+// error.
+func (p Policy) Validate(v *validation.Validator, password, name, email string) error {
+	lower := strings.ToLower(password)
+
+	v.Check(Entropy(password) >= p.MinEntropy, "password", "is too easy to guess; use a longer password with a mix of character types")
+
+	for _, part := range strings.Fields(strings.ToLower(name)) {
+		if len(part) >= 3 && strings.Contains(lower, part) {
+			v.AddError("password", "must not contain your name")
+			break
+		}
+	}
+
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if len(local) >= 3 && strings.Contains(lower, local) {
+		v.AddError("password", "must not contain your email address")
+	}
+
+	if p.Breached == nil {
+		return nil
+	}
+
+	breached, err := p.Breached.Contains(password)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, "password", "has appeared in a data breach and must not be used")
+	return nil
+}
+
+// Entropy returns a rough estimate, in bits, of how hard password is to
+// guess by brute force. Each character is worth log2 of the size of the
+// character classes in use, except that characters repeating or continuing a
+// run from the previous one ("aaa", "abc", "321") are worth a single bit.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+
+	for _, c := range password {
+		switch {
+		case c > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	perChar := math.Log2(float64(pool))
+
+	var bits float64
+	var prev rune = -1
+
+	for _, c := range password {
+		if delta := c - prev; delta >= -1 && delta <= 1 {
+			bits++
+		} else {
+			bits += perChar
+		}
+		prev = c
+	}
+
+	return bits
+}
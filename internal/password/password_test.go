@@ -0,0 +1,125 @@
+package password
+
+import (
+	"github.com/pistolricks/validation"
+	"math"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	lower := math.Log2(26)
+
+	tests := []struct {
+		password string
+		want     float64
+	}{
+		{password: "", want: 0},
+		{password: "q", want: lower},
+		{password: "qz", want: 2 * lower},
+		{password: "qqqq", want: lower + 3},
+		{password: "abcd", want: lower + 3},
+		{password: "dcba", want: lower + 3},
+		{password: "qZ", want: 2 * math.Log2(52)},
+		{password: "q5!", want: 3 * math.Log2(69)},
+		{password: "q5!Z", want: 4 * math.Log2(95)},
+		{password: "é", want: math.Log2(100)},
+		{password: "1234", want: math.Log2(10) + 3},
+	}
+
+	for _, tt := range tests {
+		got := Entropy(tt.password)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Entropy(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	breached := writeList(t, sha1Hex("Tr0ub4dor&3")+":3\n")
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		password string
+		userName string
+		email    string
+		want     string
+	}{
+		{
+			name:     "strong password",
+			policy:   Policy{MinEntropy: 40, Breached: breached},
+			password: "wq8#Lz!v0Rm2",
+			userName: "Alice Smith",
+			email:    "alice@example.com",
+		},
+		{
+			name:     "too little entropy",
+			policy:   Policy{MinEntropy: 40},
+			password: "aaaaaaaaaaaa",
+			want:     "is too easy to guess; use a longer password with a mix of character types",
+		},
+		{
+			name:     "contains a name",
+			policy:   Policy{},
+			password: "xx-SMITH-42",
+			userName: "Alice Smith",
+			email:    "a@example.com",
+			want:     "must not contain your name",
+		},
+		{
+			name:     "short name parts are ignored",
+			policy:   Policy{},
+			password: "xx-al-42",
+			userName: "Al B",
+			email:    "x@example.com",
+		},
+		{
+			name:     "contains the email's local part",
+			policy:   Policy{},
+			password: "xxBOB.JONESxx",
+			userName: "Robert",
+			email:    "bob.jones@example.com",
+			want:     "must not contain your email address",
+		},
+		{
+			name:     "short email local parts are ignored",
+			policy:   Policy{},
+			password: "xx-bo-42",
+			userName: "Robert",
+			email:    "bo@example.com",
+		},
+		{
+			name:     "breached",
+			policy:   Policy{Breached: breached},
+			password: "Tr0ub4dor&3",
+			userName: "Robert",
+			email:    "robert@example.com",
+			want:     "has appeared in a data breach and must not be used",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validation.New()
+
+			err := tt.policy.Validate(v, tt.password, tt.userName, tt.email)
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+
+			if got := v.Errors["password"]; got != tt.want {
+				t.Errorf("got error %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyValidateReturnsReadErrors(t *testing.T) {
+	breached := writeList(t, sha1Hex("Tr0ub4dor&3")+"\n")
+	breached.Close()
+
+	err := Policy{Breached: breached}.Validate(validation.New(), "wq8#Lz!v0Rm2", "", "")
+	if err == nil {
+		t.Error("got nil error, want the read error")
+	}
+}
@@ -0,0 +1,255 @@
+// Package policy decides whether a subject may perform an action on a
+// resource, using declarative rules loaded from a JSON file. It covers what a
+// bare permission code cannot, such as "users may delete their own content".
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+const (
+	OperatorEquals    = "equals"
+	OperatorNotEquals = "not_equals"
+	OperatorIn        = "in"
+	OperatorNotIn     = "not_in"
+)
+
+// Attributes describe a subject or a resource, for example
+// {"id": 42, "owner": "..."}.
+type Attributes map[string]any
+
+// PermissionSet is satisfied by models.Permissions.
+type PermissionSet interface {
+	Include(code string) bool
+}
+
+// Request is what a decision is made about.
+type Request struct {
+	Subject     Attributes
+	Permissions PermissionSet
+	Action      string
+	Resource    Attributes
+}
+
+// Decision is the outcome of Evaluate. Rule is the name of the rule that
+// decided it, and is empty when no rule applied.
+type Decision struct {
+	Allowed bool
+	Rule    string
+	Reason  string
+}
+
+// Condition compares the attribute named by Attribute, "subject.<key>" or
+// "resource.<key>", either with the attribute named by Other or with Values.
+// equals and not_equals take Other or a single value; in and not_in take
+// Values. A condition on a missing attribute never holds.
+type Condition struct {
+	Attribute string `json:"attribute"`
+	Operator  string `json:"operator"`
+	Other     string `json:"other,omitempty"`
+	Values    []any  `json:"values,omitempty"`
+}
+
+// Rule applies to a request when the action is one of Actions ("*" matches
+// any action), the subject holds every one of Permissions and every condition
+// holds.
+type Rule struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Effect      string      `json:"effect"`
+	Actions     []string    `json:"actions"`
+	Permissions []string    `json:"permissions,omitempty"`
+	Conditions  []Condition `json:"conditions,omitempty"`
+}
+
+// Policy is an ordered set of rules. A request is allowed when some allow
+// rule applies and no deny rule does; anything not allowed is denied.
+type Policy struct {
+	rules []Rule
+}
+
+// Load reads a policy file of the form {"rules": [...]}.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Policy, error) {
+	var file struct {
+		Rules []Rule `json:"rules"`
+	}
+
+	err := json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	names := make(map[string]bool)
+
+	for i, rule := range file.Rules {
+		err := rule.check()
+		if err != nil {
+			return nil, fmt.Errorf("policy: rule %d: %w", i, err)
+		}
+
+		if names[rule.Name] {
+			return nil, fmt.Errorf("policy: rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return &Policy{rules: file.Rules}, nil
+}
+
+func (r Rule) check() error {
+	switch {
+	case r.Name == "":
+		return errors.New("name must be provided")
+	case r.Effect != EffectAllow && r.Effect != EffectDeny:
+		return fmt.Errorf("%s: effect must be %q or %q", r.Name, EffectAllow, EffectDeny)
+	case len(r.Actions) == 0:
+		return fmt.Errorf("%s: actions must be provided", r.Name)
+	}
+
+	for _, c := range r.Conditions {
+		if !isAttribute(c.Attribute) {
+			return fmt.Errorf("%s: %q is not subject.<key> or resource.<key>", r.Name, c.Attribute)
+		}
+
+		if c.Other != "" && !isAttribute(c.Other) {
+			return fmt.Errorf("%s: %q is not subject.<key> or resource.<key>", r.Name, c.Other)
+		}
+
+		switch c.Operator {
+		case OperatorEquals, OperatorNotEquals:
+			if (c.Other == "") == (len(c.Values) != 1) {
+				return fmt.Errorf("%s: %s on %s needs either other or a single value", r.Name, c.Operator, c.Attribute)
+			}
+		case OperatorIn, OperatorNotIn:
+			if c.Other != "" || len(c.Values) == 0 {
+				return fmt.Errorf("%s: %s on %s needs values", r.Name, c.Operator, c.Attribute)
+			}
+		default:
+			return fmt.Errorf("%s: unknown operator %q", r.Name, c.Operator)
+		}
+	}
+
+	return nil
+}
+
+func isAttribute(name string) bool {
+	kind, key, found := strings.Cut(name, ".")
+	return found && key != "" && (kind == "subject" || kind == "resource")
+}
+
+// Evaluate decides req. Deny rules take precedence over allow rules; among
+// rules of the same effect the first in the file gives the reason.
+func (p *Policy) Evaluate(req Request) Decision {
+	var allow *Rule
+
+	for i := range p.rules {
+		rule := &p.rules[i]
+
+		if !rule.applies(req) {
+			continue
+		}
+
+		if rule.Effect == EffectDeny {
+			return Decision{Rule: rule.Name, Reason: rule.reason("denied")}
+		}
+
+		if allow == nil {
+			allow = rule
+		}
+	}
+
+	if allow == nil {
+		return Decision{Reason: fmt.Sprintf("no rule allows %s", req.Action)}
+	}
+
+	return Decision{Allowed: true, Rule: allow.Name, Reason: allow.reason("allowed")}
+}
+
+func (r *Rule) reason(outcome string) string {
+	if r.Description != "" {
+		return fmt.Sprintf("%s by %s: %s", outcome, r.Name, r.Description)
+	}
+	return fmt.Sprintf("%s by %s", outcome, r.Name)
+}
+
+func (r *Rule) applies(req Request) bool {
+	if !slices.Contains(r.Actions, req.Action) && !slices.Contains(r.Actions, "*") {
+		return false
+	}
+
+	for _, code := range r.Permissions {
+		if req.Permissions == nil || !req.Permissions.Include(code) {
+			return false
+		}
+	}
+
+	for _, c := range r.Conditions {
+		if !c.holds(req) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c Condition) holds(req Request) bool {
+	value, found := req.lookup(c.Attribute)
+	if !found {
+		return false
+	}
+
+	values := c.Values
+	if c.Other != "" {
+		other, found := req.lookup(c.Other)
+		if !found {
+			return false
+		}
+		values = []any{other}
+	}
+
+	in := slices.ContainsFunc(values, func(v any) bool { return equal(value, v) })
+
+	switch c.Operator {
+	case OperatorEquals, OperatorIn:
+		return in
+	default:
+		return !in
+	}
+}
+
+func (req Request) lookup(name string) (any, bool) {
+	kind, key, _ := strings.Cut(name, ".")
+
+	attributes := req.Subject
+	if kind == "resource" {
+		attributes = req.Resource
+	}
+
+	value, found := attributes[key]
+	return value, found && value != nil
+}
+
+// equal compares attribute values by their printed form, so that an int64 ID
+// from the database equals the same number decoded from the policy file.
+func equal(a, b any) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
@@ -0,0 +1,342 @@
+package policy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// permissions is a PermissionSet holding exactly the listed codes.
+type permissions []string
+
+func (p permissions) Include(code string) bool {
+	return slices.Contains(p, code)
+}
+
+func mustParse(t *testing.T, data string) *Policy {
+	t.Helper()
+
+	p, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return p
+}
+
+const testPolicy = `{"rules": [
+	{
+		"name": "admins",
+		"effect": "allow",
+		"actions": ["*"],
+		"permissions": ["content:admin"]
+	},
+	{
+		"name": "owners",
+		"description": "owners may manage their content",
+		"effect": "allow",
+		"actions": ["content:read", "content:delete"],
+		"conditions": [{"attribute": "resource.owner", "operator": "equals", "other": "subject.owner"}]
+	},
+	{
+		"name": "public",
+		"effect": "allow",
+		"actions": ["content:read"],
+		"conditions": [{"attribute": "resource.visibility", "operator": "in", "values": ["public", "unlisted"]}]
+	},
+	{
+		"name": "unactivated",
+		"effect": "deny",
+		"actions": ["content:delete"],
+		"conditions": [{"attribute": "subject.activated", "operator": "equals", "values": [false]}]
+	},
+	{
+		"name": "frozen",
+		"description": "frozen content cannot change",
+		"effect": "deny",
+		"actions": ["content:delete"],
+		"conditions": [{"attribute": "resource.state", "operator": "not_in", "values": ["active", "draft"]}]
+	}
+]}`
+
+func TestEvaluate(t *testing.T) {
+	p := mustParse(t, testPolicy)
+
+	owner := Attributes{"id": int64(7), "owner": "abc", "activated": true}
+	stranger := Attributes{"id": int64(8), "owner": "def", "activated": true}
+
+	tests := []struct {
+		name        string
+		subject     Attributes
+		permissions PermissionSet
+		action      string
+		resource    Attributes
+		allowed     bool
+		rule        string
+	}{
+		{
+			name:     "owner may read",
+			subject:  owner,
+			action:   "content:read",
+			resource: Attributes{"owner": "abc"},
+			allowed:  true,
+			rule:     "owners",
+		},
+		{
+			name:     "stranger may not read private content",
+			subject:  stranger,
+			action:   "content:read",
+			resource: Attributes{"owner": "abc", "visibility": "private"},
+		},
+		{
+			name:     "stranger may read public content",
+			subject:  stranger,
+			action:   "content:read",
+			resource: Attributes{"owner": "abc", "visibility": "unlisted"},
+			allowed:  true,
+			rule:     "public",
+		},
+		{
+			name:     "first matching allow rule gives the reason",
+			subject:  owner,
+			action:   "content:read",
+			resource: Attributes{"owner": "abc", "visibility": "public"},
+			allowed:  true,
+			rule:     "owners",
+		},
+		{
+			name:     "action not covered by any rule",
+			subject:  owner,
+			action:   "content:publish",
+			resource: Attributes{"owner": "abc"},
+		},
+		{
+			name:        "wildcard action with permission",
+			subject:     stranger,
+			permissions: permissions{"content:admin"},
+			action:      "content:publish",
+			allowed:     true,
+			rule:        "admins",
+		},
+		{
+			name:     "missing permission set holds no permissions",
+			subject:  stranger,
+			action:   "content:publish",
+			resource: Attributes{},
+		},
+		{
+			name:     "owner may delete active content",
+			subject:  owner,
+			action:   "content:delete",
+			resource: Attributes{"owner": "abc", "state": "active"},
+			allowed:  true,
+			rule:     "owners",
+		},
+		{
+			name:        "deny overrides an earlier allow",
+			subject:     owner,
+			permissions: permissions{"content:admin"},
+			action:      "content:delete",
+			resource:    Attributes{"owner": "abc", "state": "archived"},
+			rule:        "frozen",
+		},
+		{
+			name:     "deny on a subject attribute",
+			subject:  Attributes{"id": int64(7), "owner": "abc", "activated": false},
+			action:   "content:delete",
+			resource: Attributes{"owner": "abc", "state": "active"},
+			rule:     "unactivated",
+		},
+		{
+			name:     "allow condition on a missing resource attribute does not hold",
+			subject:  owner,
+			action:   "content:delete",
+			resource: Attributes{"state": "active"},
+		},
+		{
+			name:     "allow condition on a missing subject attribute does not hold",
+			subject:  Attributes{"id": int64(7)},
+			action:   "content:read",
+			resource: Attributes{"owner": "abc"},
+		},
+		{
+			name:     "nil attribute counts as missing",
+			subject:  Attributes{"id": int64(7), "owner": nil},
+			action:   "content:read",
+			resource: Attributes{"owner": nil},
+		},
+		{
+			name:        "not_in deny on a missing attribute does not hold",
+			subject:     owner,
+			permissions: permissions{"content:admin"},
+			action:      "content:delete",
+			resource:    Attributes{"owner": "abc"},
+			allowed:     true,
+			rule:        "admins",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := p.Evaluate(Request{
+				Subject:     tt.subject,
+				Permissions: tt.permissions,
+				Action:      tt.action,
+				Resource:    tt.resource,
+			})
+
+			if decision.Allowed != tt.allowed || decision.Rule != tt.rule {
+				t.Errorf("got allowed %t by %q, want allowed %t by %q (reason %q)", decision.Allowed, decision.Rule, tt.allowed, tt.rule, decision.Reason)
+			}
+		})
+	}
+}
+
+func TestEvaluateReasons(t *testing.T) {
+	p := mustParse(t, testPolicy)
+
+	decision := p.Evaluate(Request{
+		Subject:  Attributes{"owner": "abc"},
+		Action:   "content:delete",
+		Resource: Attributes{"owner": "abc", "state": "archived"},
+	})
+	if want := "denied by frozen: frozen content cannot change"; decision.Reason != want {
+		t.Errorf("got reason %q, want %q", decision.Reason, want)
+	}
+
+	decision = p.Evaluate(Request{Action: "content:publish"})
+	if want := "no rule allows content:publish"; decision.Reason != want {
+		t.Errorf("got reason %q, want %q", decision.Reason, want)
+	}
+
+	decision = p.Evaluate(Request{Permissions: permissions{"content:admin"}, Action: "content:publish"})
+	if want := "allowed by admins"; decision.Reason != want {
+		t.Errorf("got reason %q, want %q", decision.Reason, want)
+	}
+}
+
+func TestEvaluateComparesNumbersByValue(t *testing.T) {
+	// JSON numbers decode as float64, database IDs arrive as int64.
+	p := mustParse(t, `{"rules": [
+		{"name": "users-7-and-9", "effect": "allow", "actions": ["read"],
+		 "conditions": [{"attribute": "subject.id", "operator": "in", "values": [7, 9]}]},
+		{"name": "only-user-7", "effect": "deny", "actions": ["read"],
+		 "conditions": [{"attribute": "subject.id", "operator": "not_equals", "values": [7]}]}
+	]}`)
+
+	for _, tt := range []struct {
+		id      int64
+		allowed bool
+	}{{7, true}, {9, false}, {8, false}} {
+		decision := p.Evaluate(Request{Subject: Attributes{"id": tt.id}, Action: "read"})
+		if decision.Allowed != tt.allowed {
+			t.Errorf("id %d: got allowed %t, want %t (reason %q)", tt.id, decision.Allowed, tt.allowed, decision.Reason)
+		}
+	}
+}
+
+func TestParseRejectsInvalidPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		errMsg string
+	}{
+		{
+			name:   "missing name",
+			rules:  `{"effect": "allow", "actions": ["read"]}`,
+			errMsg: "name must be provided",
+		},
+		{
+			name:   "unknown effect",
+			rules:  `{"name": "r", "effect": "permit", "actions": ["read"]}`,
+			errMsg: "effect must be",
+		},
+		{
+			name:   "no actions",
+			rules:  `{"name": "r", "effect": "allow"}`,
+			errMsg: "actions must be provided",
+		},
+		{
+			name:   "duplicate name",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"]}, {"name": "r", "effect": "deny", "actions": ["write"]}`,
+			errMsg: `duplicate name "r"`,
+		},
+		{
+			name:   "attribute without a kind",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "owner", "operator": "equals", "values": [1]}]}`,
+			errMsg: "is not subject.<key> or resource.<key>",
+		},
+		{
+			name:   "attribute of an unknown kind",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "request.ip", "operator": "equals", "values": [1]}]}`,
+			errMsg: "is not subject.<key> or resource.<key>",
+		},
+		{
+			name:   "attribute without a key",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.", "operator": "equals", "values": [1]}]}`,
+			errMsg: "is not subject.<key> or resource.<key>",
+		},
+		{
+			name:   "invalid other",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "equals", "other": "id"}]}`,
+			errMsg: "is not subject.<key> or resource.<key>",
+		},
+		{
+			name:   "unknown operator",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "matches", "values": [1]}]}`,
+			errMsg: `unknown operator "matches"`,
+		},
+		{
+			name:   "equals with neither other nor a value",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "equals"}]}`,
+			errMsg: "needs either other or a single value",
+		},
+		{
+			name:   "equals with both other and a value",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "equals", "other": "resource.id", "values": [1]}]}`,
+			errMsg: "needs either other or a single value",
+		},
+		{
+			name:   "not_equals with several values",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "not_equals", "values": [1, 2]}]}`,
+			errMsg: "needs either other or a single value",
+		},
+		{
+			name:   "in without values",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "in"}]}`,
+			errMsg: "needs values",
+		},
+		{
+			name:   "not_in with other",
+			rules:  `{"name": "r", "effect": "allow", "actions": ["read"], "conditions": [{"attribute": "subject.id", "operator": "not_in", "other": "resource.id", "values": [1]}]}`,
+			errMsg: "needs values",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(`{"rules": [` + tt.rules + `]}`))
+			if err == nil {
+				t.Fatal("got nil error, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestParseRejectsMalformedJSON(t *testing.T) {
+	_, err := Parse([]byte(`{"rules": [`))
+	if err == nil {
+		t.Error("got nil error, want an error")
+	}
+}
+
+func TestParseAcceptsEmptyPolicy(t *testing.T) {
+	p := mustParse(t, `{"rules": []}`)
+
+	decision := p.Evaluate(Request{Action: "read"})
+	if decision.Allowed {
+		t.Error("empty policy allowed a request")
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS vendors;
\ No newline at end of file
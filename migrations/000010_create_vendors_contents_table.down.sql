@@ -0,0 +1 @@
+DROP TABLE IF EXISTS vendors_contents;
\ No newline at end of file
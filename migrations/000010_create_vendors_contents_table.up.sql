@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS vendors_contents
+(
+    vendor_id  bigint  NOT NULL REFERENCES vendors ON DELETE CASCADE,
+    content_id text    NOT NULL REFERENCES contents ON DELETE CASCADE,
+    sort_order integer NOT NULL DEFAULT 0,
+    is_cover   bool    NOT NULL DEFAULT false,
+    PRIMARY KEY (vendor_id, content_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS vendors_contents_cover_idx ON vendors_contents (vendor_id) WHERE is_cover;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS jwt_revocations;
\ No newline at end of file
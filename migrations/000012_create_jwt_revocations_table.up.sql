@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS jwt_revocations
+(
+    id         text PRIMARY KEY,
+    revoked_at timestamp with time zone    NOT NULL DEFAULT NOW(),
+    expiry     timestamp(0) with time zone NOT NULL
+);
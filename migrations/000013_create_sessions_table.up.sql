@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           bigserial PRIMARY KEY,
+    family       text UNIQUE                 NOT NULL,
+    user_id      bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ip           text                        NOT NULL DEFAULT '',
+    user_agent   text                        NOT NULL DEFAULT '',
+    last_used_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
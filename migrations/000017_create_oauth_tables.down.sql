@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS tokens_client_id_idx;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS code_challenge;
+ALTER TABLE tokens DROP COLUMN IF EXISTS redirect_uri;
+ALTER TABLE tokens DROP COLUMN IF EXISTS permissions;
+ALTER TABLE tokens DROP COLUMN IF EXISTS client_id;
+
+DROP TABLE IF EXISTS oauth_clients;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS oauth_clients
+(
+    id            bigserial PRIMARY KEY,
+    created_at    timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id       bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id     text UNIQUE                 NOT NULL,
+    secret_hash   bytea,
+    name          text                        NOT NULL,
+    redirect_uris text[]                      NOT NULL,
+    scopes        text[]                      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS client_id text REFERENCES oauth_clients (client_id) ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS permissions text[];
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS redirect_uri text;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS code_challenge text;
+
+CREATE INDEX IF NOT EXISTS tokens_client_id_idx ON tokens (client_id);
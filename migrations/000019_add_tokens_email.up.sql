@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS email citext;
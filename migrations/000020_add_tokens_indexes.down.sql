@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS tokens_user_id_scope_idx;
+DROP INDEX IF EXISTS tokens_expiry_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
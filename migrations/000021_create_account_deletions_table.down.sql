@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS contents_user_id_idx;
+DROP TABLE IF EXISTS account_deletions;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS account_deletions
+(
+    user_id      bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    requested_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    purge_at     timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_deletions_purge_at_idx ON account_deletions (purge_at);
+
+CREATE INDEX IF NOT EXISTS contents_user_id_idx ON contents (user_id);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    action     text                        NOT NULL,
+    outcome    text                        NOT NULL,
+    reason     text                        NOT NULL DEFAULT '',
+    user_id    bigint REFERENCES users ON DELETE SET NULL,
+    email      citext                      NOT NULL DEFAULT '',
+    ip         text                        NOT NULL DEFAULT '',
+    details    jsonb                       NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events (user_id);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'permissions:admin';
+
+DROP INDEX IF EXISTS permissions_code_idx;
@@ -0,0 +1,5 @@
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_idx ON permissions (code);
+
+INSERT INTO permissions (code)
+VALUES ('permissions:admin')
+ON CONFLICT (code) DO NOTHING;
@@ -0,0 +1,58 @@
+CREATE TABLE IF NOT EXISTS roles
+(
+    id          bigserial PRIMARY KEY,
+    created_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name        text UNIQUE                 NOT NULL,
+    description text                        NOT NULL DEFAULT '',
+    version     integer                     NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions
+(
+    role_id       bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+-- A role inherits every permission of its parents, and of theirs in turn.
+CREATE TABLE IF NOT EXISTS roles_parents
+(
+    role_id   bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    parent_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (role_id, parent_id),
+    CHECK (role_id <> parent_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles
+(
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_roles_role_id_idx ON users_roles (role_id);
+
+INSERT INTO roles (name, description)
+VALUES ('viewer', 'Can browse vendors'),
+       ('vendor-manager', 'Can create, edit and delete vendors'),
+       ('admin', 'Can manage users, roles and permissions')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+INNER JOIN permissions ON (roles.name, permissions.code) IN (
+    ('viewer', 'vendors:read'),
+    ('vendor-manager', 'vendors:write'),
+    ('admin', 'permissions:admin')
+)
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_parents (role_id, parent_id)
+SELECT roles.id, parents.id
+FROM roles
+INNER JOIN roles AS parents ON (roles.name, parents.name) IN (
+    ('vendor-manager', 'viewer'),
+    ('admin', 'vendor-manager')
+)
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,2 @@
+-- Redacted payloads cannot be restored.
+SELECT 1;
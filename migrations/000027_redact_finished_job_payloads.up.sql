@@ -0,0 +1 @@
+UPDATE jobs SET payload = '{}' WHERE status IN ('done', 'dead');
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS login_failures_last_failed_at_idx;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS login_failures_last_failed_at_idx ON login_failures (last_failed_at);
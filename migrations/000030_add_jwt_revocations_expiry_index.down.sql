@@ -0,0 +1 @@
+DROP INDEX IF EXISTS jwt_revocations_expiry_idx;
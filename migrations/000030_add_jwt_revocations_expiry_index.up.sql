@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS jwt_revocations_expiry_idx ON jwt_revocations (expiry);